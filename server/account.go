@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Key types the account key can be generated with (`ACCOUNT_KEY_TYPE`)
+var accountKeyTypes = map[string]acme.KeyType{
+	"rsa2048": acme.RSA2048,
+	"rsa4096": acme.RSA4096,
+	"ec256":   acme.EC256,
+	"ec384":   acme.EC384,
+}
+
+func generateAccountKey(keyType acme.KeyType) ([]byte, error) {
+	var key crypto.PrivateKey
+	var err error
+	switch keyType {
+	case acme.RSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case acme.RSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case acme.EC256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case acme.EC384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unsupported account key type %s", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encodeAccountKey(key)
+}
+
+// encodeAccountKey PEM encodes an RSA (PKCS#1) or ECDSA (SEC1) account key
+func encodeAccountKey(key crypto.PrivateKey) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+	return nil, fmt.Errorf("Unsupported account key of type %T (Expected RSA or ECDSA)", key)
+}
+
+// parseAccountKey parses a PEM encoded RSA or ECDSA account key. PKCS#1
+// (`RSA PRIVATE KEY`), PKCS#8 (`PRIVATE KEY`) and SEC1 (`EC PRIVATE KEY`)
+// blocks are accepted, as is the PEM encoded once more with base64.
+func parseAccountKey(pemData []byte) (crypto.PrivateKey, error) {
+	pemData = bytes.TrimSpace(pemData)
+	if !bytes.HasPrefix(pemData, []byte("-----BEGIN")) {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(pemData), nil)))
+		if err != nil {
+			return nil, errors.New("Error decoding private key: Neither PEM nor base64 encoded PEM")
+		}
+		pemData = decoded
+	}
+	for {
+		block, rest := pem.Decode(pemData)
+		if block == nil {
+			return nil, errors.New("Error decoding private key: No PEM block found")
+		}
+		switch block.Type {
+		case "EC PARAMETERS":
+			// Written before the key by `openssl ecparam -genkey`
+			pemData = rest
+			continue
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing PKCS#1 RSA private key: %s", err)
+			}
+			return key, nil
+		case "EC PRIVATE KEY":
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing SEC1 EC private key: %s", err)
+			}
+			return key, nil
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing PKCS#8 private key: %s", err)
+			}
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				return key, nil
+			case *ecdsa.PrivateKey:
+				return key, nil
+			}
+			return nil, fmt.Errorf("Unsupported PKCS#8 private key of type %T (Expected RSA or ECDSA)", key)
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, errors.New("Encrypted PKCS#8 private keys are not supported. Decrypt the key first (`openssl pkcs8 -in key.pem -out decrypted.pem`).")
+		}
+		return nil, fmt.Errorf("Unsupported private key PEM block `%s` (Expected `RSA PRIVATE KEY`, `EC PRIVATE KEY` or `PRIVATE KEY`)", block.Type)
+	}
+}
+
+// loadAccountKey returns the account key from the state store without
+// generating one, for commands that need an existing account
+func loadAccountKey() (crypto.PrivateKey, error) {
+	privateKey, err := getStateStore().LoadAccountKey()
+	if err != nil {
+		return nil, err
+	}
+	if privateKey == nil {
+		return nil, errors.New("No account key found in the account secret. Register user first.")
+	}
+	return parseAccountKey(privateKey)
+}
+
+// getAccountKey returns the account key from the state store, generating a
+// key of type `ACCOUNT_KEY_TYPE` if there is none yet
+func getAccountKey() (crypto.PrivateKey, error) {
+	keyTypeName := Getenv("ACCOUNT_KEY_TYPE", "rsa2048")
+	keyType, ok := accountKeyTypes[keyTypeName]
+	if !ok {
+		return nil, configError("Unknown account key type %s (Expected `rsa2048`, `rsa4096`, `ec256` or `ec384`)", keyTypeName)
+	}
+	privateKey, err := getStateStore().LoadOrCreateAccountKey(func() ([]byte, error) {
+		log.Printf("Generating a %s account key", keyTypeName)
+		return generateAccountKey(keyType)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Decoding pem key")
+	return parseAccountKey(privateKey)
+}
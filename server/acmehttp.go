@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Defaults of the HTTP client all requests to the ACME server are made with
+var ACME_HTTP_TIMEOUT = 10 * time.Second
+var ACME_DIAL_TIMEOUT = 30 * time.Second
+
+// configureACMEHTTPClient replaces the HTTP client of lego, which the ACME v2
+// and account clients use as well, so every ACME request (including issuer
+// certificate downloads) trusts the roots in `ACME_CA_BUNDLE`, goes through
+// the proxy in `HTTPS_PROXY` (unless excluded by `NO_PROXY`) and is sent with
+// `ACME_USER_AGENT`. The `Retry-After` of its responses is recorded in
+// `ACME_RETRY_AFTER`.
+func configureACMEHTTPClient() error {
+	timeout, err := time.ParseDuration(Getenv("ACME_HTTP_TIMEOUT", ACME_HTTP_TIMEOUT.String()))
+	if err != nil {
+		return fmt.Errorf("Invalid `ACME_HTTP_TIMEOUT`: %s", err)
+	}
+	dialTimeout, err := time.ParseDuration(Getenv("ACME_DIAL_TIMEOUT", ACME_DIAL_TIMEOUT.String()))
+	if err != nil {
+		return fmt.Errorf("Invalid `ACME_DIAL_TIMEOUT`: %s", err)
+	}
+	tlsConfig := &tls.Config{}
+	if bundle := Getenv("ACME_CA_BUNDLE", ""); bundle != "" {
+		tlsConfig.RootCAs, err = acmeRootCAs(strings.Split(bundle, ","))
+		if err != nil {
+			return err
+		}
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	transport = retryAfterTransport{transport: transport}
+	if userAgent := Getenv("ACME_USER_AGENT", ""); userAgent != "" {
+		transport = userAgentTransport{userAgent: userAgent, transport: transport}
+	}
+	acme.HTTPClient = http.Client{Transport: transport, Timeout: timeout}
+	return nil
+}
+
+// acmeRootCAs returns the system roots with the certificates of the PEM files
+// added
+func acmeRootCAs(paths []string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf("Error loading the system roots. Only trusting `ACME_CA_BUNDLE`: %s", err)
+		pool = x509.NewCertPool()
+	}
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		bundle, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle %s: %s", path, err)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", path)
+		}
+		log.Printf("Trusting the ACME server certificates issued by %s", path)
+	}
+	return pool, nil
+}
+
+// userAgentTransport sends every request with the User-Agent, replacing the
+// one set by lego
+type userAgentTransport struct {
+	userAgent string
+	transport http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the request
+	withUserAgent := *req
+	withUserAgent.Header = make(http.Header)
+	for key, values := range req.Header {
+		withUserAgent.Header[key] = values
+	}
+	withUserAgent.Header.Set("User-Agent", t.userAgent)
+	return t.transport.RoundTrip(&withUserAgent)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// withACMEHTTPClient configures the ACME HTTP client from the environment and
+// restores the default client afterwards
+func withACMEHTTPClient(t *testing.T, env map[string]string, test func()) {
+	httpClient := acme.HTTPClient
+	defer func() {
+		acme.HTTPClient = httpClient
+	}()
+	for key, value := range env {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+	err := configureACMEHTTPClient()
+	if err != nil {
+		t.Fatalf("Error configuring the ACME HTTP client: %s", err)
+	}
+	test()
+}
+
+func TestACMEHTTPClientTrustsCABundle(t *testing.T) {
+	userAgents := []string{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		json.NewEncoder(w).Encode(map[string]string{
+			"new-authz":   "https://" + r.Host + "/new-authz",
+			"new-cert":    "https://" + r.Host + "/new-cert",
+			"new-reg":     "https://" + r.Host + "/new-reg",
+			"revoke-cert": "https://" + r.Host + "/revoke-cert",
+		})
+	}))
+	defer server.Close()
+	bundle := writeTempFile(t, "ca-bundle", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]}))
+	defer os.Remove(bundle)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	user := LegoUser{Email: "ops@example.com", key: key}
+
+	withACMEHTTPClient(t, map[string]string{"ACME_CA_BUNDLE": "", "ACME_USER_AGENT": ""}, func() {
+		if _, err := acme.NewClient(server.URL+"/directory", &user, acme.RSA2048); err == nil {
+			t.Fatalf("Expected the private root not to be trusted")
+		}
+	})
+	withACMEHTTPClient(t, map[string]string{"ACME_CA_BUNDLE": bundle, "ACME_USER_AGENT": "example-certs/1.0"}, func() {
+		if _, err := acme.NewClient(server.URL+"/directory", &user, acme.RSA2048); err != nil {
+			t.Fatalf("Error connecting with the CA bundle: %s", err)
+		}
+		if _, err := fetchACMEv2Directory(server.URL + "/directory"); err != nil {
+			t.Fatalf("Error fetching directory with the CA bundle: %s", err)
+		}
+	})
+	if len(userAgents) != 2 || userAgents[0] != "example-certs/1.0" || userAgents[1] != "example-certs/1.0" {
+		t.Fatalf("Expected the custom User-Agent in the requests: %v", userAgents)
+	}
+}
+
+func TestACMEHTTPClientConfiguration(t *testing.T) {
+	blocked := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer server.Close()
+	defer close(blocked)
+	withACMEHTTPClient(t, map[string]string{"ACME_HTTP_TIMEOUT": "50ms", "ACME_CA_BUNDLE": ""}, func() {
+		_, err := fetchACMEv2Directory(server.URL + "/directory")
+		if err == nil || !strings.Contains(err.Error(), "Timeout") {
+			t.Fatalf("Expected the request to time out: %v", err)
+		}
+	})
+
+	for key, value := range map[string]string{"ACME_HTTP_TIMEOUT": "soon", "ACME_CA_BUNDLE": "/does/not/exist.pem"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+		if err := configureACMEHTTPClient(); err == nil {
+			t.Errorf("Expected an error for `%s`", key)
+		}
+		os.Setenv(key, "")
+	}
+	if acme.HTTPClient.Timeout != 10*time.Second {
+		t.Fatalf("Expected the client to be unchanged: %s", acme.HTTPClient.Timeout)
+	}
+}
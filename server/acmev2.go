@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// ACMEClient is what the server needs from an ACME client. It is implemented
+// by the vendored lego client for ACME v1 servers and by ACMEv2Client for
+// RFC 8555 servers.
+type ACMEClient interface {
+	SetChallengeProvider(challenge acme.Challenge, p acme.ChallengeProvider) error
+	ExcludeChallenges(challenges []acme.Challenge)
+	AgreeToTOS() error
+	ObtainCertificate(domains []string, bundle bool, privKey crypto.PrivateKey, mustStaple bool) (acme.CertificateResource, map[string]error)
+	ObtainCertificateForCSR(csr x509.CertificateRequest, bundle bool) (acme.CertificateResource, map[string]error)
+	RevokeCertificate(certificate []byte) error
+}
+
+// How often and for how long pending authorizations and orders are polled
+var ACME_POLL_INTERVAL = 2 * time.Second
+var ACME_POLL_TIMEOUT = 2 * time.Minute
+
+const ACME_BAD_NONCE_ERROR = "urn:ietf:params:acme:error:badNonce"
+
+// OCSP Must-Staple (TLS Feature extension with status_request)
+var mustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+}
+
+// ACMEv2Directory is the directory of an RFC 8555 server
+type ACMEv2Directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	RevokeCert string `json:"revokeCert"`
+	KeyChange  string `json:"keyChange"`
+	Meta       struct {
+		TermsOfService          string `json:"termsOfService"`
+		ExternalAccountRequired bool   `json:"externalAccountRequired"`
+	} `json:"meta"`
+}
+
+type ACMEv2Account struct {
+	Status    string   `json:"status"`
+	Contact   []string `json:"contact,omitempty"`
+	CreatedAt string   `json:"createdAt,omitempty"`
+	Orders    string   `json:"orders,omitempty"`
+}
+
+type acmeV2Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeV2Order struct {
+	Status         string             `json:"status"`
+	Identifiers    []acmeV2Identifier `json:"identifiers"`
+	Authorizations []string           `json:"authorizations"`
+	Finalize       string             `json:"finalize"`
+	Certificate    string             `json:"certificate,omitempty"`
+	Error          *acme.RemoteError  `json:"error,omitempty"`
+}
+
+type acmeV2Authorization struct {
+	Status     string            `json:"status"`
+	Identifier acmeV2Identifier  `json:"identifier"`
+	Challenges []acmeV2Challenge `json:"challenges"`
+	Wildcard   bool              `json:"wildcard,omitempty"`
+}
+
+type acmeV2Challenge struct {
+	Type   string            `json:"type"`
+	URL    string            `json:"url"`
+	Status string            `json:"status"`
+	Token  string            `json:"token"`
+	Error  *acme.RemoteError `json:"error,omitempty"`
+}
+
+// ACMEv2Client issues certificates with an RFC 8555 server: orders are
+// created for the identifiers (including wildcards), their authorizations
+// solved with the challenge providers and the order finalized with a CSR.
+// Every request after the account is registered is signed with the account
+// URL as key ID, and resources are fetched with POST-as-GET.
+type ACMEv2Client struct {
+	directory *ACMEv2Directory
+	key       crypto.PrivateKey
+	// URL of the account. Empty until the account is registered.
+	accountURL string
+	keyType    acme.KeyType
+	providers  map[acme.Challenge]acme.ChallengeProvider
+	nonces     []string
+}
+
+// fetchACMEv2Directory returns the directory at the URL, or nil if it's the
+// directory of an ACME v1 server
+func fetchACMEv2Directory(directoryURL string) (*ACMEv2Directory, error) {
+	resp, err := acme.HTTPClient.Get(directoryURL)
+	if err != nil {
+		return nil, CAUnavailableError{URL: directoryURL, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, CAUnavailableError{URL: directoryURL, Err: fmt.Errorf("Status Code: %d", resp.StatusCode)}
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Getting directory %s did not return 200 (Status Code: %d)", directoryURL, resp.StatusCode)
+	}
+	directory := &ACMEv2Directory{}
+	err = json.NewDecoder(resp.Body).Decode(directory)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing directory %s: %s", directoryURL, err)
+	}
+	if directory.NewOrder == "" {
+		return nil, nil
+	}
+	return directory, nil
+}
+
+func newACMEv2Client(directory *ACMEv2Directory, key crypto.PrivateKey, accountURL string, keyType acme.KeyType) *ACMEv2Client {
+	return &ACMEv2Client{
+		directory:  directory,
+		key:        key,
+		accountURL: accountURL,
+		keyType:    keyType,
+		providers:  make(map[acme.Challenge]acme.ChallengeProvider),
+	}
+}
+
+// connectACMEServer returns the client for the protocol the server at the
+// directory URL speaks. The user needs a registration for ACME v2 servers.
+func connectACMEServer(directoryURL string, user LegoUser, keyType acme.KeyType) (ACMEClient, error) {
+	directory, err := fetchACMEv2Directory(directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	if directory != nil {
+		if user.Registration == nil || user.Registration.URI == "" {
+			return nil, errors.New("The account needs to be registered before using the ACME v2 server")
+		}
+		return newACMEv2Client(directory, user.key, user.Registration.URI, keyType), nil
+	}
+	client, err := acme.NewClient(directoryURL, &user, keyType)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Register creates the account of the key and agrees to the terms of
+// service, binding it to the external account if there is one. If the key
+// already has an account the existing one is returned.
+func (c *ACMEv2Client) Register(contact []string, binding *ExternalAccountBinding) (ACMEv2Account, error) {
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	if len(contact) > 0 {
+		payload["contact"] = contact
+	}
+	if binding != nil {
+		signed, err := binding.sign(c.key, c.directory.NewAccount)
+		if err != nil {
+			return ACMEv2Account{}, err
+		}
+		payload["externalAccountBinding"] = signed
+	}
+	return c.newAccount(payload)
+}
+
+// FindAccount returns the existing account of the key without creating one
+func (c *ACMEv2Client) FindAccount() (ACMEv2Account, error) {
+	return c.newAccount(map[string]interface{}{"onlyReturnExisting": true})
+}
+
+func (c *ACMEv2Client) newAccount(payload map[string]interface{}) (ACMEv2Account, error) {
+	account := ACMEv2Account{}
+	c.accountURL = ""
+	headers, err := c.post(c.directory.NewAccount, payload, &account)
+	if err != nil {
+		return account, err
+	}
+	c.accountURL = headers.Get("Location")
+	if c.accountURL == "" {
+		return account, errors.New("The ACME server didn't return the account URL")
+	}
+	return account, nil
+}
+
+// Account fetches the account
+func (c *ACMEv2Client) Account() (ACMEv2Account, error) {
+	return c.UpdateAccount(map[string]interface{}{})
+}
+
+// UpdateAccount updates the fields of the account in the payload (e.g.
+// `contact` or `status`) and returns the updated account
+func (c *ACMEv2Client) UpdateAccount(payload map[string]interface{}) (ACMEv2Account, error) {
+	account := ACMEv2Account{}
+	_, err := c.post(c.accountURL, payload, &account)
+	return account, err
+}
+
+// ChangeKey rolls the account over to the new key. The inner JWS is signed by
+// the new key and holds the account URL and the old key.
+func (c *ACMEv2Client) ChangeKey(newKey crypto.PrivateKey) error {
+	if c.directory.KeyChange == "" {
+		return errors.New("The ACME server doesn't support key changes")
+	}
+	oldKey, err := accountPublicKey(c.key)
+	if err != nil {
+		return err
+	}
+	newPublicKey, err := accountPublicKey(newKey)
+	if err != nil {
+		return err
+	}
+	inner, err := json.Marshal(map[string]interface{}{
+		"account": c.accountURL,
+		"oldKey":  jose.JsonWebKey{Key: oldKey},
+	})
+	if err != nil {
+		return err
+	}
+	signed, err := signJWS(newKey, map[string]interface{}{
+		"jwk": jose.JsonWebKey{Key: newPublicKey},
+		"url": c.directory.KeyChange,
+	}, inner)
+	if err != nil {
+		return err
+	}
+	// The outer JWS is signed by the current key like any other request
+	jws := map[string]string{}
+	err = json.Unmarshal(signed, &jws)
+	if err != nil {
+		return err
+	}
+	_, err = c.post(c.directory.KeyChange, jws, nil)
+	if err != nil {
+		return err
+	}
+	c.key = newKey
+	return nil
+}
+
+// SetChallengeProvider sets the provider that solves challenges of the type
+func (c *ACMEv2Client) SetChallengeProvider(challenge acme.Challenge, p acme.ChallengeProvider) error {
+	c.providers[challenge] = p
+	return nil
+}
+
+// ExcludeChallenges removes the providers of the challenge types
+func (c *ACMEv2Client) ExcludeChallenges(challenges []acme.Challenge) {
+	for _, challenge := range challenges {
+		delete(c.providers, challenge)
+	}
+}
+
+// AgreeToTOS does nothing, since the terms of service are agreed to when the
+// account is registered
+func (c *ACMEv2Client) AgreeToTOS() error {
+	return nil
+}
+
+// ObtainCertificate obtains a certificate for the domains with the private
+// key, or with a new key of the key type of the client if there is none
+func (c *ACMEv2Client) ObtainCertificate(domains []string, bundle bool, privKey crypto.PrivateKey, mustStaple bool) (acme.CertificateResource, map[string]error) {
+	if privKey == nil {
+		var err error
+		privKey, err = generateCertificateKey(c.keyType)
+		if err != nil {
+			return acme.CertificateResource{}, allFailed(domains, err)
+		}
+	}
+	template := &x509.CertificateRequest{DNSNames: domains}
+	if len(domains[0]) <= 64 {
+		template.Subject.CommonName = domains[0]
+	}
+	if mustStaple {
+		template.ExtraExtensions = append(template.ExtraExtensions, mustStapleExtension)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, privKey)
+	if err != nil {
+		return acme.CertificateResource{}, allFailed(domains, err)
+	}
+	certificates, failures := c.obtain(domains, csr, bundle)
+	if len(failures) > 0 {
+		return certificates, failures
+	}
+	certificates.PrivateKey, err = encodeAccountKey(privKey)
+	if err != nil {
+		return certificates, allFailed(domains, err)
+	}
+	return certificates, nil
+}
+
+// ObtainCertificateForCSR obtains a certificate for the domains of the CSR
+func (c *ACMEv2Client) ObtainCertificateForCSR(csr x509.CertificateRequest, bundle bool) (acme.CertificateResource, map[string]error) {
+	certificates, failures := c.obtain(csrDomains(&csr), csr.Raw, bundle)
+	if len(failures) > 0 {
+		return certificates, failures
+	}
+	certificates.CSR = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	return certificates, nil
+}
+
+// RevokeCertificate revokes the PEM encoded certificate
+func (c *ACMEv2Client) RevokeCertificate(certificate []byte) error {
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		return errors.New("No PEM block found in the certificate")
+	}
+	_, err := c.post(c.directory.RevokeCert, map[string]interface{}{
+		"certificate": base64.RawURLEncoding.EncodeToString(block.Bytes),
+	}, nil)
+	return err
+}
+
+// obtain creates an order for the domains, solves its authorizations and
+// finalizes it with the DER encoded CSR. The errors are returned for each
+// domain, with wildcards as `*.<domain>`.
+func (c *ACMEv2Client) obtain(domains []string, csr []byte, bundle bool) (acme.CertificateResource, map[string]error) {
+	identifiers := []acmeV2Identifier{}
+	for _, domain := range domains {
+		identifiers = append(identifiers, acmeV2Identifier{Type: "dns", Value: domain})
+	}
+	order := acmeV2Order{}
+	headers, err := c.post(c.directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order)
+	if err != nil {
+		// Returned as is, since rate limits are mostly hit here
+		log.Printf("Error creating order for %s: %s", domains, err)
+		return acme.CertificateResource{}, allFailed(domains, err)
+	}
+	orderURL := headers.Get("Location")
+
+	failures := make(map[string]error)
+	for _, authorizationURL := range order.Authorizations {
+		domain, err := c.authorize(authorizationURL)
+		if err != nil {
+			if domain == "" {
+				return acme.CertificateResource{}, allFailed(domains, err)
+			}
+			log.Printf("Error validating %s: %s", domain, err)
+			failures[domain] = err
+		}
+	}
+	if len(failures) > 0 {
+		return acme.CertificateResource{}, failures
+	}
+
+	log.Printf("Validations for %s succeeded. Finalizing order %s", domains, orderURL)
+	_, err = c.post(order.Finalize, map[string]interface{}{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &order)
+	if err == nil {
+		order, err = c.waitForOrder(orderURL, order)
+	}
+	if err != nil {
+		return acme.CertificateResource{}, allFailed(domains, wrapError("Error finalizing order", err))
+	}
+	_, chain, err := c.signedRequest(order.Certificate, nil)
+	if err != nil {
+		return acme.CertificateResource{}, allFailed(domains, wrapError("Error downloading certificate", err))
+	}
+
+	certificates := acme.CertificateResource{
+		Domain:        domains[0],
+		CertURL:       order.Certificate,
+		CertStableURL: order.Certificate,
+		AccountRef:    c.accountURL,
+		Certificate:   chain,
+	}
+	// The chain starts with the issued certificate
+	block, rest := pem.Decode(chain)
+	if block == nil {
+		return acme.CertificateResource{}, allFailed(domains, errors.New("The certificate returned by the ACME server isn't PEM encoded"))
+	}
+	certificates.IssuerCertificate = bytes.TrimSpace(rest)
+	if !bundle {
+		certificates.Certificate = pem.EncodeToMemory(block)
+	}
+	return certificates, nil
+}
+
+// authorize solves the authorization at the URL if it isn't valid yet and
+// returns the domain it's for
+func (c *ACMEv2Client) authorize(authorizationURL string) (string, error) {
+	authorization := acmeV2Authorization{}
+	_, err := c.post(authorizationURL, nil, &authorization)
+	if err != nil {
+		return "", wrapError(fmt.Sprintf("Error getting authorization %s", authorizationURL), err)
+	}
+	domain := authorization.Identifier.Value
+	if authorization.Wildcard {
+		domain = "*." + domain
+	}
+	if authorization.Status == "valid" {
+		return domain, nil
+	}
+
+	challenge, provider, err := c.selectChallenge(authorization)
+	if err != nil {
+		return domain, err
+	}
+	thumbprint, err := c.thumbprint()
+	if err != nil {
+		return domain, err
+	}
+	keyAuth := challenge.Token + "." + thumbprint
+	// Wildcards are validated with the record of the base domain
+	err = provider.Present(authorization.Identifier.Value, challenge.Token, keyAuth)
+	if err != nil {
+		return domain, fmt.Errorf("Error presenting %s challenge: %s", challenge.Type, err)
+	}
+	defer func() {
+		if err := provider.CleanUp(authorization.Identifier.Value, challenge.Token, keyAuth); err != nil {
+			log.Printf("Error cleaning up %s challenge for %s: %s", challenge.Type, domain, err)
+		}
+	}()
+	if challenge.Type == string(acme.DNS01) {
+		err = waitForDNSRecord(provider, authorization.Identifier.Value, keyAuth)
+		if err != nil {
+			return domain, err
+		}
+	}
+
+	log.Printf("Validating %s with the %s challenge", domain, challenge.Type)
+	_, err = c.post(challenge.URL, map[string]interface{}{}, nil)
+	if err != nil {
+		return domain, err
+	}
+	return domain, c.waitForAuthorization(authorizationURL)
+}
+
+// selectChallenge returns the first challenge of the authorization there is
+// a provider for
+func (c *ACMEv2Client) selectChallenge(authorization acmeV2Authorization) (acmeV2Challenge, acme.ChallengeProvider, error) {
+	offered := []string{}
+	for _, challenge := range authorization.Challenges {
+		if provider, ok := c.providers[acme.Challenge(challenge.Type)]; ok {
+			return challenge, provider, nil
+		}
+		offered = append(offered, challenge.Type)
+	}
+	if authorization.Wildcard {
+		return acmeV2Challenge{}, nil, fmt.Errorf("Wildcard domains can only be validated with the %s challenge (Offered: %s)", DNS_01_CHALLENGE, offered)
+	}
+	return acmeV2Challenge{}, nil, fmt.Errorf("No provider for the challenges offered for %s: %s", authorization.Identifier.Value, offered)
+}
+
+// waitForDNSRecord waits until the challenge record has propagated, like the
+// lego client does before notifying the server
+func waitForDNSRecord(provider acme.ChallengeProvider, domain string, keyAuth string) error {
+	fqdn, value, _ := acme.DNS01Record(domain, keyAuth)
+	timeout, interval := 60*time.Second, 2*time.Second
+	if provider, ok := provider.(acme.ChallengeProviderTimeout); ok {
+		timeout, interval = provider.Timeout()
+	}
+	log.Printf("Waiting for the DNS record %s to propagate", fqdn)
+	return acme.WaitFor(timeout, interval, func() (bool, error) {
+		return acme.PreCheckDNS(fqdn, value)
+	})
+}
+
+func (c *ACMEv2Client) waitForAuthorization(authorizationURL string) error {
+	deadline := time.Now().Add(ACME_POLL_TIMEOUT)
+	for {
+		authorization := acmeV2Authorization{}
+		_, err := c.post(authorizationURL, nil, &authorization)
+		if err != nil {
+			return err
+		}
+		switch authorization.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, challenge := range authorization.Challenges {
+				if challenge.Error != nil {
+					return *challenge.Error
+				}
+			}
+			return fmt.Errorf("Authorization for %s is %s", authorization.Identifier.Value, authorization.Status)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Authorization for %s is still %s after %s", authorization.Identifier.Value, authorization.Status, ACME_POLL_TIMEOUT)
+		}
+		time.Sleep(ACME_POLL_INTERVAL)
+	}
+}
+
+func (c *ACMEv2Client) waitForOrder(orderURL string, order acmeV2Order) (acmeV2Order, error) {
+	deadline := time.Now().Add(ACME_POLL_TIMEOUT)
+	for {
+		switch order.Status {
+		case "valid":
+			return order, nil
+		case "invalid":
+			if order.Error != nil {
+				return order, *order.Error
+			}
+			return order, errors.New("The order is invalid")
+		}
+		if time.Now().After(deadline) {
+			return order, fmt.Errorf("The order is still %s after %s", order.Status, ACME_POLL_TIMEOUT)
+		}
+		time.Sleep(ACME_POLL_INTERVAL)
+		_, err := c.post(orderURL, nil, &order)
+		if err != nil {
+			return order, err
+		}
+	}
+}
+
+func (c *ACMEv2Client) thumbprint() (string, error) {
+	publicKey, err := accountPublicKey(c.key)
+	if err != nil {
+		return "", err
+	}
+	jwk := jose.JsonWebKey{Key: publicKey}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// post signs the JSON encoded payload and decodes the response into result.
+// A nil payload is a POST-as-GET request.
+func (c *ACMEv2Client) post(url string, payload interface{}, result interface{}) (http.Header, error) {
+	var content []byte
+	if payload != nil {
+		var err error
+		content, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	headers, body, err := c.signedRequest(url, content)
+	if err != nil {
+		return headers, err
+	}
+	if result != nil {
+		err = json.Unmarshal(body, result)
+		if err != nil {
+			return headers, fmt.Errorf("Error parsing response of %s: %s", url, err)
+		}
+	}
+	return headers, nil
+}
+
+// signedRequest signs the content with the account key, identified by the
+// account URL once there is one. Requests rejected for their nonce are sent
+// again with a new one.
+func (c *ACMEv2Client) signedRequest(url string, content []byte) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		protected := map[string]interface{}{"nonce": nonce, "url": url}
+		if c.accountURL == "" {
+			publicKey, err := accountPublicKey(c.key)
+			if err != nil {
+				return nil, nil, err
+			}
+			protected["jwk"] = jose.JsonWebKey{Key: publicKey}
+		} else {
+			protected["kid"] = c.accountURL
+		}
+		signed, err := signJWS(c.key, protected, content)
+		if err != nil {
+			return nil, nil, err
+		}
+		headers, body, err := c.request(url, signed)
+		if remoteErr, ok := err.(acme.RemoteError); ok && remoteErr.Type == ACME_BAD_NONCE_ERROR && attempt < 3 {
+			log.Printf("Retrying request to %s with a new nonce", url)
+			continue
+		}
+		return headers, body, err
+	}
+}
+
+// request posts the JWS and returns the response body. Error responses are
+// returned as `acme.RemoteError`.
+func (c *ACMEv2Client) request(url string, jws []byte) (http.Header, []byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := acme.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, CAUnavailableError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.nonces = append(c.nonces, nonce)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.Header, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		remoteErr := acme.RemoteError{}
+		json.Unmarshal(body, &remoteErr)
+		remoteErr.StatusCode = resp.StatusCode
+		return resp.Header, body, remoteErr
+	}
+	return resp.Header, body, nil
+}
+
+func (c *ACMEv2Client) nonce() (string, error) {
+	if len(c.nonces) > 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		return nonce, nil
+	}
+	resp, err := acme.HTTPClient.Head(c.directory.NewNonce)
+	if err != nil {
+		return "", CAUnavailableError{URL: c.directory.NewNonce, Err: err}
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("The ACME server didn't return a nonce")
+	}
+	return nonce, nil
+}
+
+// signJWS returns the flattened JSON serialization of the payload signed with
+// the key (RS256, ES256 or ES384) and the protected header
+func signJWS(key crypto.PrivateKey, protected map[string]interface{}, payload []byte) ([]byte, error) {
+	var algorithm string
+	var hash crypto.Hash
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		algorithm, hash = "RS256", crypto.SHA256
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			algorithm, hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			algorithm, hash = "ES384", crypto.SHA384
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", key.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key of type %T (Expected RSA or ECDSA)", key)
+	}
+	protected["alg"] = algorithm
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := hash.New()
+	digest.Write([]byte(input))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		// The signature is R and S, each padded to the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[size-len(rBytes):size], rBytes)
+		copy(signature[2*size-len(sBytes):], sBytes)
+	}
+	return json.Marshal(map[string]string{
+		"protected": base64.RawURLEncoding.EncodeToString(header),
+		"payload":   base64.RawURLEncoding.EncodeToString(payload),
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+func allFailed(domains []string, err error) map[string]error {
+	failures := make(map[string]error)
+	for _, domain := range domains {
+		failures[domain] = err
+	}
+	return failures
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// fakeACMEv2Server is an RFC 8555 server issuing a single order. Every
+// identifier is valid except the failing ones.
+type fakeACMEv2Server struct {
+	sync.Mutex
+	server   *httptest.Server
+	requests []string
+	// Key of the account, once registered
+	key     *jose.JsonWebKey
+	contact []string
+	status  string
+	// Identifiers of the order and whether their authorizations are valid
+	identifiers []acmeV2Identifier
+	valid       []bool
+	failing     map[string]bool
+	csr         *x509.CertificateRequest
+	caKey       *ecdsa.PrivateKey
+	caCert      *x509.Certificate
+	// Revoked certificates (base64url encoded DER)
+	revoked []string
+	// Errors in the requests, e.g. a missing or wrong `url` header
+	errors []string
+	// HMAC keys of the external accounts by key ID. New accounts need to be
+	// bound to one of them if set.
+	eab map[string][]byte
+	// Key IDs new accounts were bound to
+	bindings []string
+	// Problem type finalizing orders fails with, if set
+	finalizeProblem string
+}
+
+func newFakeACMEv2Server(t *testing.T) *fakeACMEv2Server {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %s", err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+	f := &fakeACMEv2Server{status: "valid", failing: make(map[string]bool), caKey: caKey, caCert: caCert}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeACMEv2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", len(f.requests)))
+	problem := func(status int, problemType string, detail string) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + problemType, "detail": detail})
+	}
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   f.server.URL + "/new-nonce",
+			"newAccount": f.server.URL + "/new-account",
+			"newOrder":   f.server.URL + "/new-order",
+			"revokeCert": f.server.URL + "/revoke-cert",
+			"keyChange":  f.server.URL + "/key-change",
+			"meta":       map[string]interface{}{"termsOfService": f.server.URL + "/terms", "externalAccountRequired": f.eab != nil},
+		})
+		return
+	}
+	if r.URL.Path == "/new-nonce" {
+		w.WriteHeader(200)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	payload, err := f.verify(r, body)
+	if err != nil {
+		f.errors = append(f.errors, fmt.Sprintf("%s: %s", r.URL.Path, err))
+		problem(400, "malformed", err.Error())
+		return
+	}
+	accountURL := f.server.URL + "/acct/1"
+	switch {
+	case r.URL.Path == "/new-account":
+		if f.key == nil {
+			request := struct {
+				Contact                []string        `json:"contact"`
+				OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+				ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+			}{}
+			json.Unmarshal(payload, &request)
+			if request.OnlyReturnExisting {
+				problem(400, "accountDoesNotExist", "No account exists with the provided key")
+				return
+			}
+			if f.eab != nil {
+				if err := f.verifyBinding(request.ExternalAccountBinding, requestHeader(body).JWK); err != nil {
+					problem(401, "unauthorized", err.Error())
+					return
+				}
+			}
+			f.key = requestHeader(body).JWK
+			f.contact = request.Contact
+			w.Header().Set("Location", accountURL)
+			w.WriteHeader(201)
+		} else {
+			w.Header().Set("Location", accountURL)
+			w.WriteHeader(200)
+		}
+		json.NewEncoder(w).Encode(ACMEv2Account{Status: f.status, Contact: f.contact})
+	case r.URL.Path == "/acct/1":
+		update := struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}{}
+		json.Unmarshal(payload, &update)
+		if update.Contact != nil {
+			f.contact = update.Contact
+		}
+		if update.Status != "" {
+			f.status = update.Status
+		}
+		json.NewEncoder(w).Encode(ACMEv2Account{Status: f.status, Contact: f.contact})
+	case r.URL.Path == "/new-order":
+		request := acmeV2Order{}
+		json.Unmarshal(payload, &request)
+		f.identifiers = request.Identifiers
+		f.valid = make([]bool, len(f.identifiers))
+		f.csr = nil
+		w.Header().Set("Location", f.server.URL+"/order/1")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(f.order())
+	case r.URL.Path == "/order/1":
+		json.NewEncoder(w).Encode(f.order())
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		i := f.index(r.URL.Path)
+		if i < 0 {
+			problem(404, "malformed", "No such authorization")
+			return
+		}
+		json.NewEncoder(w).Encode(f.authorization(i))
+	case strings.HasPrefix(r.URL.Path, "/chall/"):
+		i := f.index(r.URL.Path)
+		if i < 0 || string(payload) != "{}" {
+			problem(400, "malformed", "Invalid challenge response")
+			return
+		}
+		f.valid[i] = !f.failing[f.identifiers[i].Value]
+		json.NewEncoder(w).Encode(f.authorization(i).Challenges[0])
+	case r.URL.Path == "/finalize/1":
+		request := struct {
+			CSR string `json:"csr"`
+		}{}
+		json.Unmarshal(payload, &request)
+		der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || f.order().Status != "ready" {
+			problem(403, "orderNotReady", "The order can't be finalized")
+			return
+		}
+		if f.finalizeProblem != "" {
+			problem(400, f.finalizeProblem, "The CSR was rejected")
+			return
+		}
+		f.csr = csr
+		json.NewEncoder(w).Encode(f.order())
+	case r.URL.Path == "/cert/1":
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(0x5678),
+			Subject:      f.csr.Subject,
+			DNSNames:     f.csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, template, f.caCert, f.csr.PublicKey, f.caKey)
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})
+	case r.URL.Path == "/revoke-cert":
+		request := struct {
+			Certificate string `json:"certificate"`
+		}{}
+		json.Unmarshal(payload, &request)
+		f.revoked = append(f.revoked, request.Certificate)
+		w.WriteHeader(200)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+type fakeJWSHeader struct {
+	URL   string           `json:"url"`
+	Nonce string           `json:"nonce"`
+	KeyID string           `json:"kid"`
+	JWK   *jose.JsonWebKey `json:"jwk"`
+}
+
+func requestHeader(body []byte) fakeJWSHeader {
+	header := fakeJWSHeader{}
+	jws := struct {
+		Protected string `json:"protected"`
+	}{}
+	json.Unmarshal(body, &jws)
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(protected, &header)
+	return header
+}
+
+func (f *fakeACMEv2Server) count(request string) int {
+	f.Lock()
+	defer f.Unlock()
+	count := 0
+	for _, r := range f.requests {
+		if r == request {
+			count++
+		}
+	}
+	return count
+}
+
+// verify checks the JWS of the request like an RFC 8555 server: new accounts
+// are signed with the key in the header, everything else with the key of the
+// account referenced by its URL. It returns the payload.
+func (f *fakeACMEv2Server) verify(r *http.Request, body []byte) ([]byte, error) {
+	header := requestHeader(body)
+	if header.URL != f.server.URL+r.URL.Path {
+		return nil, fmt.Errorf("Expected the url header %s, got %s", f.server.URL+r.URL.Path, header.URL)
+	}
+	if header.Nonce == "" {
+		return nil, fmt.Errorf("No nonce")
+	}
+	var key *jose.JsonWebKey
+	if r.URL.Path == "/new-account" {
+		if header.JWK == nil || header.KeyID != "" {
+			return nil, fmt.Errorf("New accounts need a jwk header")
+		}
+		key = header.JWK
+	} else {
+		if header.KeyID != f.server.URL+"/acct/1" || header.JWK != nil || f.key == nil {
+			return nil, fmt.Errorf("Expected the kid header of the account, got %s", header.KeyID)
+		}
+		key = f.key
+	}
+	signed, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return signed.Verify(key.Key)
+}
+
+// verifyBinding checks that the external account binding is the account key
+// signed with the HMAC key of a known external account
+func (f *fakeACMEv2Server) verifyBinding(binding json.RawMessage, key *jose.JsonWebKey) error {
+	jws := struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{}
+	if len(binding) == 0 || json.Unmarshal(binding, &jws) != nil {
+		return fmt.Errorf("An external account binding is required")
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+		URL       string `json:"url"`
+	}{}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(protected, &header)
+	hmacKey, ok := f.eab[header.KeyID]
+	if !ok || header.Algorithm != "HS256" || header.URL != f.server.URL+"/new-account" {
+		return fmt.Errorf("Invalid external account binding header: %s", protected)
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(jws.Protected + "." + jws.Payload))
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("Invalid external account binding signature")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	boundKey := jose.JsonWebKey{}
+	json.Unmarshal(payload, &boundKey)
+	bound, err := boundKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("Invalid external account binding key: %s", err)
+	}
+	expected, _ := key.Thumbprint(crypto.SHA256)
+	if string(bound) != string(expected) {
+		return fmt.Errorf("The external account binding is for another key")
+	}
+	f.bindings = append(f.bindings, header.KeyID)
+	return nil
+}
+
+func (f *fakeACMEv2Server) index(path string) int {
+	var i int
+	_, err := fmt.Sscanf(path[strings.LastIndex(path, "/")+1:], "%d", &i)
+	if err != nil || i >= len(f.identifiers) {
+		return -1
+	}
+	return i
+}
+
+func (f *fakeACMEv2Server) order() acmeV2Order {
+	order := acmeV2Order{
+		Status:      "ready",
+		Identifiers: f.identifiers,
+		Finalize:    f.server.URL + "/finalize/1",
+	}
+	for i := range f.identifiers {
+		order.Authorizations = append(order.Authorizations, fmt.Sprintf("%s/authz/%d", f.server.URL, i))
+		if !f.valid[i] {
+			order.Status = "pending"
+		}
+	}
+	if f.csr != nil {
+		order.Status = "valid"
+		order.Certificate = f.server.URL + "/cert/1"
+	}
+	return order
+}
+
+func (f *fakeACMEv2Server) authorization(i int) acmeV2Authorization {
+	value := f.identifiers[i].Value
+	authorization := acmeV2Authorization{
+		Status:     "pending",
+		Identifier: acmeV2Identifier{Type: "dns", Value: strings.TrimPrefix(value, "*.")},
+		Wildcard:   strings.HasPrefix(value, "*."),
+	}
+	challengeURL := fmt.Sprintf("%s/chall/%d", f.server.URL, i)
+	dns01 := acmeV2Challenge{Type: string(acme.DNS01), URL: challengeURL, Status: "pending", Token: fmt.Sprintf("token-%d", i)}
+	if f.valid[i] {
+		authorization.Status, dns01.Status = "valid", "valid"
+	} else if f.failing[value] && f.contains(f.requests, "POST /chall/"+fmt.Sprint(i)) {
+		authorization.Status, dns01.Status = "invalid", "invalid"
+		dns01.Error = &acme.RemoteError{Type: "urn:ietf:params:acme:error:dns", Detail: "NXDOMAIN looking up TXT for _acme-challenge." + authorization.Identifier.Value}
+	}
+	authorization.Challenges = []acmeV2Challenge{dns01}
+	// Wildcards can only be validated with DNS-01
+	if !authorization.Wildcard {
+		authorization.Challenges = append(authorization.Challenges, acmeV2Challenge{Type: string(acme.HTTP01), URL: challengeURL, Status: dns01.Status, Token: dns01.Token})
+	}
+	return authorization
+}
+
+func (f *fakeACMEv2Server) contains(requests []string, request string) bool {
+	for _, r := range requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingProvider records the domains of the challenges it presents
+type recordingProvider struct {
+	presented []string
+	cleanedUp []string
+}
+
+func (p *recordingProvider) Present(domain, token, keyAuth string) error {
+	p.presented = append(p.presented, domain)
+	return nil
+}
+
+func (p *recordingProvider) CleanUp(domain, token, keyAuth string) error {
+	p.cleanedUp = append(p.cleanedUp, domain)
+	return nil
+}
+
+// withFakeACMEv2Server points the ACME client at the fake server
+func withFakeACMEv2Server(t *testing.T, fake *fakeACMEv2Server, test func()) {
+	defer fake.server.Close()
+	for key, value := range map[string]string{
+		"CA_SERVER":                     fake.server.URL + "/directory",
+		"LETS_ENCRYPT_USER_SECRET_NAME": "lets-encrypt-user",
+	} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+	test()
+}
+
+// withFastPolling skips the DNS propagation checks and polls quickly
+func withFastPolling(test func()) {
+	preCheckDNS, interval := acme.PreCheckDNS, ACME_POLL_INTERVAL
+	defer func() {
+		acme.PreCheckDNS, ACME_POLL_INTERVAL = preCheckDNS, interval
+	}()
+	acme.PreCheckDNS = func(fqdn, value string) (bool, error) {
+		return true, nil
+	}
+	ACME_POLL_INTERVAL = 10 * time.Millisecond
+	test()
+}
+
+func TestFetchACMEv2Directory(t *testing.T) {
+	fake := newFakeACMEv2Server(t)
+	defer fake.server.Close()
+	directory, err := fetchACMEv2Directory(fake.server.URL + "/directory")
+	if err != nil || directory == nil || directory.NewOrder != fake.server.URL+"/new-order" || directory.Meta.TermsOfService != fake.server.URL+"/terms" {
+		t.Fatalf("Unexpected directory: %#v %v", directory, err)
+	}
+
+	v1 := newFakeACMEServer()
+	defer v1.server.Close()
+	directory, err = fetchACMEv2Directory(v1.server.URL + "/directory")
+	if err != nil || directory != nil {
+		t.Fatalf("Expected no ACME v2 directory: %#v %v", directory, err)
+	}
+}
+
+func TestACMEv2ObtainWildcardCertificate(t *testing.T) {
+	fake := newFakeACMEv2Server(t)
+	defer fake.server.Close()
+	directory, err := fetchACMEv2Directory(fake.server.URL + "/directory")
+	if err != nil {
+		t.Fatalf("Error fetching directory: %s", err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := newACMEv2Client(directory, key, "", acme.EC256)
+	account, err := client.Register([]string{"mailto:ops@example.com"}, nil)
+	if err != nil || client.accountURL != fake.server.URL+"/acct/1" || account.Contact[0] != "mailto:ops@example.com" {
+		t.Fatalf("Unexpected account: %#v %s %v", account, client.accountURL, err)
+	}
+
+	provider := &recordingProvider{}
+	client.SetChallengeProvider(acme.DNS01, provider)
+	withFastPolling(func() {
+		certificates, failures := client.ObtainCertificate([]string{"example.com", "*.example.com"}, false, nil, false)
+		if len(failures) > 0 {
+			t.Fatalf("Error obtaining certificate: %v %v", failures, fake.errors)
+		}
+		certificate, err := parseCertificate(certificates.Certificate)
+		if err != nil {
+			t.Fatalf("Error parsing certificate: %s", err)
+		}
+		domains := certificateDomains(certificate)
+		if len(domains) != 2 || domains[0] != "example.com" || domains[1] != "*.example.com" {
+			t.Fatalf("Unexpected domains: %v", domains)
+		}
+		if err := certificate.CheckSignatureFrom(fake.caCert); err != nil {
+			t.Fatalf("Expected the certificate to be issued by the CA: %s", err)
+		}
+		if !strings.Contains(string(certificates.IssuerCertificate), "CERTIFICATE") || len(certificates.PrivateKey) == 0 {
+			t.Fatalf("Expected the issuer certificate and the private key: %#v", certificates)
+		}
+		// The wildcard is validated with the record of the base domain
+		if len(provider.presented) != 2 || provider.presented[1] != "example.com" || len(provider.cleanedUp) != 2 {
+			t.Fatalf("Unexpected challenges: %v %v", provider.presented, provider.cleanedUp)
+		}
+
+		err = client.RevokeCertificate(certificates.Certificate)
+		if err != nil || len(fake.revoked) != 1 {
+			t.Fatalf("Certificate was not revoked: %v %v", fake.revoked, err)
+		}
+	})
+	if len(fake.errors) > 0 {
+		t.Fatalf("Invalid requests: %v", fake.errors)
+	}
+}
+
+func TestACMEv2ObtainCertificateFailures(t *testing.T) {
+	fake := newFakeACMEv2Server(t)
+	defer fake.server.Close()
+	fake.failing["*.broken.example.com"] = true
+	directory, _ := fetchACMEv2Directory(fake.server.URL + "/directory")
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := newACMEv2Client(directory, key, "", acme.EC256)
+	if _, err := client.Register(nil, nil); err != nil {
+		t.Fatalf("Error registering account: %s", err)
+	}
+
+	// Without a DNS-01 provider wildcards can't be validated
+	client.SetChallengeProvider(acme.HTTP01, &recordingProvider{})
+	_, failures := client.ObtainCertificate([]string{"*.example.com"}, false, nil, false)
+	if err := failures["*.example.com"]; err == nil || !strings.Contains(err.Error(), "dns-01") {
+		t.Fatalf("Expected the wildcard to need DNS-01: %v", failures)
+	}
+
+	client.ExcludeChallenges([]acme.Challenge{acme.HTTP01})
+	client.SetChallengeProvider(acme.DNS01, &recordingProvider{})
+	withFastPolling(func() {
+		_, failures = client.ObtainCertificate([]string{"example.com", "*.broken.example.com"}, false, nil, false)
+	})
+	if len(failures) != 1 || failures["*.broken.example.com"] == nil || !strings.Contains(failures["*.broken.example.com"].Error(), "NXDOMAIN") {
+		t.Fatalf("Expected the wildcard to fail: %v", failures)
+	}
+
+	// Errors finalizing the order keep the ACME error, so they aren't retried
+	fake.finalizeProblem = "badCSR"
+	withFastPolling(func() {
+		_, failures = client.ObtainCertificate([]string{"example.com"}, false, nil, false)
+	})
+	err := failures["example.com"]
+	if err == nil || !strings.Contains(err.Error(), "Error finalizing order") || classifyError(ObtainError{Failures: failures}) != ERROR_PERMANENT {
+		t.Fatalf("Expected a permanent error finalizing the order: %v", failures)
+	}
+}
+
+func TestACMEv2Registration(t *testing.T) {
+	fake := newFakeACMEv2Server(t)
+	secrets := fakeAccountSecrets(t, "")
+	withFakeACMEv2Server(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			user, err := ensureRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error registering user: %s", err)
+			}
+			if user.Registration.URI != fake.server.URL+"/acct/1" || user.Registration.TosURL != fake.server.URL+"/terms" {
+				t.Fatalf("Unexpected registration: %#v", user.Registration)
+			}
+
+			// The stored account is used to issue certificates
+			client, err := connectACMEServer(caServer(), user, acme.RSA2048)
+			if err != nil {
+				t.Fatalf("Error connecting to the ACME server: %s", err)
+			}
+			if v2, ok := client.(*ACMEv2Client); !ok || v2.accountURL != user.Registration.URI {
+				t.Fatalf("Expected an ACME v2 client for the account: %#v", client)
+			}
+
+			accountClient, err := newAccountClient(caServer(), user.key)
+			if err != nil {
+				t.Fatalf("Error creating account client: %s", err)
+			}
+			details, err := accountClient.UpdateContact(user.Registration.URI, []string{"mailto:team@example.com"})
+			if err != nil || details.Contact[0] != "mailto:team@example.com" || details.TosURL != fake.server.URL+"/terms" {
+				t.Fatalf("Contact was not updated: %#v %v", details, err)
+			}
+			details, err = accountClient.Deactivate(user.Registration.URI)
+			if err != nil || details.Status != "deactivated" {
+				t.Fatalf("Account was not deactivated: %#v %v", details, err)
+			}
+		})
+	})
+	if len(fake.errors) > 0 {
+		t.Fatalf("Invalid requests: %v", fake.errors)
+	}
+}
+
+// TestPebble obtains a wildcard certificate from the Pebble test server at
+// `PEBBLE_DIRECTORY`, e.g. started with `PEBBLE_VA_ALWAYS_VALID=1 pebble`.
+// `PEBBLE_CA` is the path of the certificate Pebble serves its API with.
+func TestPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+	if caFile := os.Getenv("PEBBLE_CA"); caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(caCert)
+		httpClient := acme.HTTPClient
+		defer func() {
+			acme.HTTPClient = httpClient
+		}()
+		acme.HTTPClient = http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	directory, err := fetchACMEv2Directory(directoryURL)
+	if err != nil || directory == nil {
+		t.Fatalf("Expected an ACME v2 directory: %v", err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := newACMEv2Client(directory, key, "", acme.EC256)
+	if _, err := client.Register([]string{"mailto:ops@example.com"}, nil); err != nil {
+		t.Fatalf("Error registering account: %s", err)
+	}
+	client.SetChallengeProvider(acme.DNS01, &recordingProvider{})
+	withFastPolling(func() {
+		certificates, failures := client.ObtainCertificate([]string{"example.com", "*.example.com"}, false, nil, false)
+		if len(failures) > 0 {
+			t.Fatalf("Error obtaining certificate: %v", failures)
+		}
+		if err := client.RevokeCertificate(certificates.Certificate); err != nil {
+			t.Fatalf("Error revoking certificate: %s", err)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var CERTIFICATE_API_GROUP = "lets-encrypt.thejsj.com"
+var CERTIFICATE_API_VERSION = "v1alpha1"
+
+// Certificate is the custom resource defined in kubernetes-certificate-crd.yml
+type Certificate struct {
+	Kind       string            `json:"kind,omitempty"`
+	ApiVersion string            `json:"apiVersion,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Spec       CertificateSpec   `json:"spec"`
+	Status     CertificateStatus `json:"status,omitempty"`
+}
+
+type CertificateSpec struct {
+	Domains    []string `json:"domains"`
+	SecretName string   `json:"secretName"`
+	// One of `rsa2048`, `rsa4096`, `rsa8192`, `ec256` or `ec384`
+	KeyType string `json:"keyType,omitempty"`
+	// `http-01` or `dns-01`
+	ChallengeType string `json:"challengeType,omitempty"`
+	DNSProvider   string `json:"dnsProvider,omitempty"`
+	// Go duration (e.g. `720h`)
+	RenewBefore string `json:"renewBefore,omitempty"`
+	// `legacy` or `tls`
+	Layout     string `json:"layout,omitempty"`
+	LegacyKeys bool   `json:"legacyKeys,omitempty"`
+	// `secret/<name>` or `configmap/<name>` holding a CSR under `csrKey`
+	// (defaults to `tls.csr`)
+	CSRSource string `json:"csrSource,omitempty"`
+	CSRKey    string `json:"csrKey,omitempty"`
+	// Issue the certificate for the domains that pass validation if others fail
+	AllowPartial bool `json:"allowPartial,omitempty"`
+}
+
+type CertificateStatus struct {
+	Conditions []CertificateCondition `json:"conditions,omitempty"`
+	NotAfter   string                 `json:"notAfter,omitempty"`
+	LastError  string                 `json:"lastError,omitempty"`
+	// Errors returned by the ACME server for each domain on the last failure
+	Failures map[string]string `json:"failures,omitempty"`
+	// Domains left out of the certificate with `allowPartial` and their errors
+	ExcludedDomains map[string]string `json:"excludedDomains,omitempty"`
+}
+
+const (
+	CERTIFICATE_READY   = "Ready"
+	CERTIFICATE_ISSUING = "Issuing"
+	CERTIFICATE_FAILED  = "Failed"
+)
+
+type CertificateCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+}
+
+type CertificateList struct {
+	Metadata ListMeta      `json:"metadata"`
+	Items    []Certificate `json:"items"`
+}
+
+type CertificateWatchEvent struct {
+	Type   string      `json:"type"`
+	Object Certificate `json:"object"`
+}
+
+// Target returns the secret and settings the certificate is issued with
+func (c *Certificate) Target() (CertificateTarget, error) {
+	target := CertificateTarget{
+		Namespace:     c.Metadata.Namespace,
+		SecretName:    c.Spec.SecretName,
+		Domains:       c.Spec.Domains,
+		ChallengeType: c.Spec.ChallengeType,
+		DNSProvider:   c.Spec.DNSProvider,
+		Layout:        c.Spec.Layout,
+		LegacyKeys:    c.Spec.LegacyKeys,
+		AllowPartial:  c.Spec.AllowPartial,
+		Owner: &OwnerReference{
+			ApiVersion: fmt.Sprintf("%s/%s", CERTIFICATE_API_GROUP, CERTIFICATE_API_VERSION),
+			Kind:       "Certificate",
+			Name:       c.Metadata.Name,
+			UID:        c.Metadata.UID,
+			Controller: true,
+		},
+	}
+	if len(target.Domains) == 0 || target.SecretName == "" {
+		return target, configError("Certificate %s/%s requires `domains` and `secretName`", c.Metadata.Namespace, c.Metadata.Name)
+	}
+	if c.Spec.KeyType != "" {
+		keyType, err := parseCertificateKeyType(c.Spec.KeyType)
+		if err != nil {
+			return target, err
+		}
+		target.KeyType = keyType
+	}
+	if c.Spec.RenewBefore != "" {
+		renewBefore, err := time.ParseDuration(c.Spec.RenewBefore)
+		if err != nil {
+			return target, configError("Invalid `renewBefore` duration: %s", err)
+		}
+		target.RenewBefore = renewBefore
+	}
+	if _, err := secretLayout(target); err != nil {
+		return target, err
+	}
+	csrSource, err := parseCSRSource(c.Spec.CSRSource, c.Spec.CSRKey)
+	if err != nil {
+		return target, err
+	}
+	target.CSR = csrSource
+	return target, nil
+}
+
+// SetCondition sets the status of a condition, keeping its transition time if
+// the status didn't change
+func (c *Certificate) SetCondition(conditionType string, status bool, reason string, message string) {
+	condition := CertificateCondition{
+		Type:               conditionType,
+		Status:             "False",
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: time.Now().UTC().Format(time.RFC3339),
+	}
+	if status {
+		condition.Status = "True"
+	}
+	for i, existing := range c.Status.Conditions {
+		if existing.Type != conditionType {
+			continue
+		}
+		if existing.Status == condition.Status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		c.Status.Conditions[i] = condition
+		return
+	}
+	c.Status.Conditions = append(c.Status.Conditions, condition)
+}
+
+func (c *Certificate) String() string {
+	return fmt.Sprintf("%s/%s", c.Metadata.Namespace, c.Metadata.Name)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CertificateClient is a typed client for the Certificate custom resource
+type CertificateClient struct {
+	// Namespace the client operates on. Empty lists and watches Certificates
+	// in all namespaces.
+	namespace string
+}
+
+func NewCertificateClient(namespace string) *CertificateClient {
+	return &CertificateClient{namespace: namespace}
+}
+
+func (c *CertificateClient) resourcePath(namespace string) string {
+	base := fmt.Sprintf("/apis/%s/%s", CERTIFICATE_API_GROUP, CERTIFICATE_API_VERSION)
+	if namespace == "" {
+		return base + "/certificates"
+	}
+	return fmt.Sprintf("%s/namespaces/%s/certificates", base, namespace)
+}
+
+func (c *CertificateClient) List() (*CertificateList, error) {
+	statusCode, body, err := kubernetesRequest("GET", c.resourcePath(c.namespace), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("Listing certificates did not return 200 (Status Code: %d): %s", statusCode, string(body))
+	}
+	list := &CertificateList{}
+	err = json.Unmarshal(body, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *CertificateClient) Get(namespace string, name string) (*Certificate, error) {
+	path := fmt.Sprintf("%s/%s", c.resourcePath(namespace), name)
+	statusCode, body, err := kubernetesRequest("GET", path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("Getting certificate %s/%s did not return 200 (Status Code: %d): %s", namespace, name, statusCode, string(body))
+	}
+	certificate := &Certificate{}
+	err = json.Unmarshal(body, certificate)
+	if err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+// ErrCertificateConflict is returned when a certificate was changed
+// concurrently
+var ErrCertificateConflict = errors.New("Certificate was changed concurrently")
+
+// UpdateStatus replaces the status of the certificate through the `status`
+// subresource and returns the updated certificate. The update is rejected with
+// `ErrCertificateConflict` if the certificate changed since it was read.
+func (c *CertificateClient) UpdateStatus(certificate *Certificate) (*Certificate, error) {
+	path := fmt.Sprintf("%s/%s/status", c.resourcePath(certificate.Metadata.Namespace), certificate.Metadata.Name)
+	certificate.Kind = "Certificate"
+	certificate.ApiVersion = fmt.Sprintf("%s/%s", CERTIFICATE_API_GROUP, CERTIFICATE_API_VERSION)
+	update, err := json.Marshal(certificate)
+	if err != nil {
+		return nil, err
+	}
+	statusCode, body, err := kubernetesRequest("PUT", path, "application/json", update)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 409 {
+		return nil, ErrCertificateConflict
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("Updating status of certificate %s did not return 200 (Status Code: %d): %s", certificate.String(), statusCode, string(body))
+	}
+	updated := &Certificate{}
+	err = json.Unmarshal(body, updated)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Watch starts watching Certificates from the given resource version
+func (c *CertificateClient) Watch(resourceVersion string) (*CertificateWatcher, error) {
+	path := fmt.Sprintf("%s?watch=true&resourceVersion=%s", c.resourcePath(c.namespace), resourceVersion)
+	stream, err := kubernetesStream(path)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateWatcher{stream: stream, decoder: json.NewDecoder(stream)}, nil
+}
+
+type CertificateWatcher struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+}
+
+// Next blocks until the next event is received. It returns io.EOF once the
+// watch is closed by the API server.
+func (w *CertificateWatcher) Next() (CertificateWatchEvent, error) {
+	event := CertificateWatchEvent{}
+	err := w.decoder.Decode(&event)
+	if err != nil {
+		return event, err
+	}
+	if event.Type == "ERROR" {
+		// Usually `410 Gone` once the resource version is too old
+		return event, fmt.Errorf("Certificate watch returned an error")
+	}
+	return event, nil
+}
+
+func (w *CertificateWatcher) Close() error {
+	return w.stream.Close()
+}
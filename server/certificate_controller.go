@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// How long to wait before retrying a Certificate that failed to be issued
+var FAILURE_RETRY_INTERVAL = 10 * time.Minute
+
+// CertificateController reconciles Certificate custom resources
+type CertificateController struct {
+	sync.Mutex
+	email  string
+	client *CertificateClient
+	// Certificates keyed by `namespace/name`
+	certificates map[string]Certificate
+	// When each Certificate is next checked and the generation it was last
+	// checked at. Changes to the spec are always checked right away.
+	nextCheck         map[string]time.Time
+	checkedGeneration map[string]int64
+	changed           chan bool
+}
+
+func NewCertificateController(email string, client *CertificateClient) *CertificateController {
+	return &CertificateController{
+		email:             email,
+		client:            client,
+		certificates:      make(map[string]Certificate),
+		nextCheck:         make(map[string]time.Time),
+		checkedGeneration: make(map[string]int64),
+		changed:           make(chan bool, 1),
+	}
+}
+
+func runCertificateController(email string) error {
+	err := loadRenewalSettings()
+	if err != nil {
+		return err
+	}
+	namespace := Getenv("WATCH_NAMESPACE", "")
+	if namespace == "*" {
+		namespace = ""
+	} else if namespace == "" {
+		namespace, err = getNamespace()
+		if err != nil {
+			return err
+		}
+	}
+
+	controller := NewCertificateController(email, NewCertificateClient(namespace))
+	go controller.watch()
+	log.Printf("Starting certificate controller (Renew before: %s, Check interval: %s)", RENEW_BEFORE, RENEW_CHECK_INTERVAL)
+	for {
+		select {
+		case <-controller.changed:
+		case <-time.After(time.Minute):
+		}
+		controller.reconcile()
+	}
+}
+
+// watch lists all Certificates and then watches them for changes. If the
+// watch is closed or expires the Certificates are listed again.
+func (c *CertificateController) watch() {
+	for {
+		list, err := c.client.List()
+		if err != nil {
+			log.Printf("Error listing certificates: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		c.Lock()
+		c.certificates = make(map[string]Certificate)
+		for _, certificate := range list.Items {
+			c.certificates[certificate.String()] = certificate
+		}
+		c.Unlock()
+		c.notify()
+
+		log.Printf("Watching certificates from resource version %s", list.Metadata.ResourceVersion)
+		watcher, err := c.client.Watch(list.Metadata.ResourceVersion)
+		if err != nil {
+			log.Printf("Error watching certificates: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for {
+			event, err := watcher.Next()
+			if err == io.EOF {
+				log.Printf("Certificate watch closed")
+				break
+			}
+			if err != nil {
+				log.Printf("Error watching certificates: %s", err)
+				break
+			}
+			c.Lock()
+			if event.Type == "DELETED" {
+				delete(c.certificates, event.Object.String())
+			} else {
+				c.certificates[event.Object.String()] = event.Object
+			}
+			c.Unlock()
+			c.notify()
+		}
+		watcher.Close()
+	}
+}
+
+func (c *CertificateController) notify() {
+	select {
+	case c.changed <- true:
+	default:
+	}
+}
+
+// reconcile checks every Certificate that changed or is due for a check
+func (c *CertificateController) reconcile() {
+	c.Lock()
+	due := []Certificate{}
+	certificateKeys := []string{}
+	for key := range c.certificates {
+		certificateKeys = append(certificateKeys, key)
+	}
+	sort.Strings(certificateKeys)
+	for _, key := range certificateKeys {
+		certificate := c.certificates[key]
+		generation, checked := c.checkedGeneration[key]
+		if !checked || generation != certificate.Metadata.Generation || time.Now().After(c.nextCheck[key]) {
+			due = append(due, certificate)
+		}
+	}
+	for key := range c.nextCheck {
+		if _, ok := c.certificates[key]; !ok {
+			delete(c.nextCheck, key)
+			delete(c.checkedGeneration, key)
+		}
+	}
+	c.Unlock()
+
+	for _, certificate := range due {
+		err := c.reconcileCertificate(certificate)
+		next := time.Now().Add(RENEW_CHECK_INTERVAL)
+		if err != nil {
+			// A status that couldn't be saved is saved again with the retry,
+			// since every error path returns an error
+			log.Printf("Error reconciling certificate %s: %s", certificate.String(), err)
+			next = time.Now().Add(FAILURE_RETRY_INTERVAL)
+		}
+		c.Lock()
+		c.nextCheck[certificate.String()] = next
+		c.checkedGeneration[certificate.String()] = certificate.Metadata.Generation
+		c.Unlock()
+	}
+}
+
+// reconcileCertificate issues or renews the certificate if needed and records
+// the outcome in its status
+func (c *CertificateController) reconcileCertificate(certificate Certificate) error {
+	target, err := certificate.Target()
+	if err != nil {
+		certificate.SetCondition(CERTIFICATE_READY, false, "InvalidSpec", err.Error())
+		certificate.SetCondition(CERTIFICATE_FAILED, true, "InvalidSpec", err.Error())
+		certificate.Status.LastError = err.Error()
+		c.updateStatus(certificate)
+		return err
+	}
+
+	existing, action := inspectCertificate(target)
+	if action == "" {
+		// Up to date, so the ACME servers aren't contacted at all
+		return c.updateIssuedStatus(certificate, target, existing)
+	}
+	log.Printf("Certificate %s: %s", certificate.String(), action)
+	certificate.SetCondition(CERTIFICATE_ISSUING, true, action, "")
+	certificate, err = c.updateStatus(certificate)
+	if err != nil {
+		return err
+	}
+	issued, err := issueWithFailover(target, c.email, func(target CertificateTarget, email string) (acme.CertificateResource, error) {
+		return issueCertificate(target, email, existing, action)
+	})
+	certificate.SetCondition(CERTIFICATE_ISSUING, false, "", "")
+	if err != nil {
+		// A certificate that is only due for renewal is still usable
+		certificate.SetCondition(CERTIFICATE_READY, action == RENEW_CERTIFICATE, "", "")
+		certificate.SetCondition(CERTIFICATE_FAILED, true, action, err.Error())
+		certificate.Status.LastError = err.Error()
+		certificate.Status.Failures = nil
+		if obtainErr, ok := err.(ObtainError); ok {
+			certificate.Status.Failures = make(map[string]string)
+			for domain, failure := range obtainErr.Failures {
+				certificate.Status.Failures[domain] = failure.Error()
+			}
+		}
+		c.updateStatus(certificate)
+		return err
+	}
+	return c.updateIssuedStatus(certificate, target, issued)
+}
+
+// updateIssuedStatus records that the certificate of the target is issued and
+// when it expires
+func (c *CertificateController) updateIssuedStatus(certificate Certificate, target CertificateTarget, issued acme.CertificateResource) error {
+	certificate.SetCondition(CERTIFICATE_READY, true, "", "")
+	certificate.SetCondition(CERTIFICATE_FAILED, false, "", "")
+	certificate.Status.LastError = ""
+	certificate.Status.Failures = nil
+	certificate.Status.ExcludedDomains = nil
+	if allowPartial(target) {
+		excluded, err := loadExcludedDomains(target)
+		if err != nil {
+			log.Printf("Error reading the excluded domains of certificate %s: %s", certificate.String(), err)
+		} else if len(excluded) > 0 {
+			certificate.Status.ExcludedDomains = excluded
+		}
+	}
+	if notAfter, err := acme.GetPEMCertExpiration(issued.Certificate); err == nil {
+		certificate.Status.NotAfter = notAfter.UTC().Format(time.RFC3339)
+	}
+	_, err := c.updateStatus(certificate)
+	return err
+}
+
+// How often the status of a certificate that was changed concurrently is
+// read again and updated
+var STATUS_UPDATE_ATTEMPTS = 3
+
+// updateStatus saves the status of the certificate if it changed. If the
+// certificate was changed in the meantime (e.g. its spec was edited) the status
+// is applied to the current certificate instead.
+func (c *CertificateController) updateStatus(certificate Certificate) (Certificate, error) {
+	c.Lock()
+	previous := c.certificates[certificate.String()]
+	c.Unlock()
+	previousStatus, _ := json.Marshal(previous.Status)
+	status, _ := json.Marshal(certificate.Status)
+	if string(previousStatus) == string(status) {
+		return certificate, nil
+	}
+	var updated *Certificate
+	var err error
+	for attempt := 1; ; attempt++ {
+		updated, err = c.client.UpdateStatus(&certificate)
+		if err != ErrCertificateConflict || attempt == STATUS_UPDATE_ATTEMPTS {
+			break
+		}
+		log.Printf("Certificate %s changed while updating its status. Reading it again", certificate.String())
+		current, err := c.client.Get(certificate.Metadata.Namespace, certificate.Metadata.Name)
+		if err != nil {
+			log.Printf("Error getting certificate %s: %s", certificate.String(), err)
+			return certificate, err
+		}
+		current.Status = certificate.Status
+		certificate = *current
+	}
+	if err != nil {
+		log.Printf("Error updating status of certificate %s: %s", certificate.String(), err)
+		return certificate, err
+	}
+	c.Lock()
+	c.certificates[updated.String()] = *updated
+	c.Unlock()
+	return *updated, nil
+}
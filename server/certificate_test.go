@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestCertificateTarget(t *testing.T) {
+	certificate := Certificate{
+		Metadata: ObjectMeta{Name: "example", Namespace: "default"},
+		Spec: CertificateSpec{
+			Domains:       []string{"example.com", "www.example.com"},
+			SecretName:    "example-tls",
+			KeyType:       "ec256",
+			ChallengeType: DNS_01_CHALLENGE,
+			DNSProvider:   "rfc2136",
+			RenewBefore:   "240h",
+		},
+	}
+	target, err := certificate.Target()
+	if err != nil {
+		t.Fatalf("Error getting target: %s", err)
+	}
+	if target.Namespace != "default" || target.SecretName != "example-tls" || len(target.Domains) != 2 {
+		t.Fatalf("Unexpected target: %v", target)
+	}
+	if target.KeyType != acme.EC256 || target.RenewBefore != 240*time.Hour {
+		t.Fatalf("Unexpected target settings: %v", target)
+	}
+
+	certificate.Spec.KeyType = "dsa"
+	_, err = certificate.Target()
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown key type")
+	}
+	certificate.Spec.KeyType = ""
+	certificate.Spec.Domains = nil
+	_, err = certificate.Target()
+	if err == nil {
+		t.Fatalf("Expected an error for a certificate without domains")
+	}
+}
+
+func TestCertificateSetCondition(t *testing.T) {
+	certificate := Certificate{}
+	certificate.SetCondition(CERTIFICATE_READY, false, "", "")
+	certificate.Status.Conditions[0].LastTransitionTime = "2017-01-01T00:00:00Z"
+
+	certificate.SetCondition(CERTIFICATE_READY, false, "obtain", "Still failing")
+	if len(certificate.Status.Conditions) != 1 {
+		t.Fatalf("Expected the condition to be replaced: %v", certificate.Status.Conditions)
+	}
+	if certificate.Status.Conditions[0].LastTransitionTime != "2017-01-01T00:00:00Z" {
+		t.Fatalf("Transition time changed without a status change")
+	}
+
+	certificate.SetCondition(CERTIFICATE_READY, true, "", "")
+	if certificate.Status.Conditions[0].Status != "True" || certificate.Status.Conditions[0].LastTransitionTime == "2017-01-01T00:00:00Z" {
+		t.Fatalf("Expected a transition to True: %v", certificate.Status.Conditions[0])
+	}
+}
+
+// fakeCertificatesServer serves Certificates and their status subresource,
+// and secrets from the fake secrets server
+type fakeCertificatesServer struct {
+	sync.Mutex
+	secrets      *fakeSecretsServer
+	certificates map[string]Certificate
+	// Statuses saved, in order
+	statuses []CertificateStatus
+	// Number of status updates to reject with a conflict
+	conflicts int
+}
+
+func (f *fakeCertificatesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := fmt.Sprintf("/apis/%s/%s/namespaces/", CERTIFICATE_API_GROUP, CERTIFICATE_API_VERSION)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		f.secrets.ServeHTTP(w, r)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimSuffix(r.URL.Path, "/status")
+	certificate, ok := f.certificates[path]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(certificate)
+	case "PUT":
+		update := Certificate{}
+		json.NewDecoder(r.Body).Decode(&update)
+		if f.conflicts > 0 || update.Metadata.ResourceVersion != certificate.Metadata.ResourceVersion {
+			f.conflicts--
+			// The certificate was changed by someone else
+			certificate.Metadata.ResourceVersion += "1"
+			f.certificates[path] = certificate
+			w.WriteHeader(409)
+			return
+		}
+		certificate.Status = update.Status
+		certificate.Metadata.ResourceVersion += "1"
+		f.certificates[path] = certificate
+		f.statuses = append(f.statuses, update.Status)
+		json.NewEncoder(w).Encode(certificate)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func conditionStatus(certificate Certificate, conditionType string) string {
+	for _, condition := range certificate.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status
+		}
+	}
+	return ""
+}
+
+func TestCertificateControllerReconcile(t *testing.T) {
+	webroot, err := ioutil.TempDir("", "webroot")
+	if err != nil {
+		t.Fatalf("Error creating webroot: %s", err)
+	}
+	defer os.RemoveAll(webroot)
+	defer func(location string) { WEBROOT_LOCATION = location }(WEBROOT_LOCATION)
+	WEBROOT_LOCATION = webroot
+
+	acmeServer := newFakeACMEv2Server(t)
+	path := fmt.Sprintf("/apis/%s/%s/namespaces/default/certificates/example", CERTIFICATE_API_GROUP, CERTIFICATE_API_VERSION)
+	fake := &fakeCertificatesServer{
+		secrets: fakeAccountSecrets(t, ""),
+		certificates: map[string]Certificate{
+			path: {
+				Metadata: ObjectMeta{Name: "example", Namespace: "default", ResourceVersion: "1", Generation: 1},
+				Spec:     CertificateSpec{Domains: []string{"example.com", "www.example.com"}, SecretName: "example-tls"},
+			},
+		},
+	}
+	controller := NewCertificateController("ops@example.com", NewCertificateClient("default"))
+	// reconcile the certificate as listed by the watch
+	reconcile := func() (Certificate, error) {
+		fake.Lock()
+		certificate := fake.certificates[path]
+		fake.Unlock()
+		controller.Lock()
+		controller.certificates[certificate.String()] = certificate
+		controller.Unlock()
+		err := controller.reconcileCertificate(certificate)
+		fake.Lock()
+		defer fake.Unlock()
+		return fake.certificates[path], err
+	}
+	// editSpec changes the spec like `kubectl edit`
+	editSpec := func(edit func(spec *CertificateSpec)) {
+		fake.Lock()
+		defer fake.Unlock()
+		certificate := fake.certificates[path]
+		edit(&certificate.Spec)
+		certificate.Metadata.Generation++
+		certificate.Metadata.ResourceVersion += "1"
+		fake.certificates[path] = certificate
+	}
+
+	withFakeACMEv2Server(t, acmeServer, func() {
+		withFakeKubernetesServer(t, fake, func() {
+			withFastPolling(func() {
+				if _, err := ensureRegistration("ops@example.com"); err != nil {
+					t.Fatalf("Error registering account: %s", err)
+				}
+
+				// Issued: Issuing, then Ready
+				certificate, err := reconcile()
+				if err != nil {
+					t.Fatalf("Error reconciling certificate: %s %v", err, acmeServer.errors)
+				}
+				if len(fake.statuses) != 2 || conditionStatus(Certificate{Status: fake.statuses[0]}, CERTIFICATE_ISSUING) != "True" {
+					t.Fatalf("Expected the Issuing condition to be saved first: %v", fake.statuses)
+				}
+				if conditionStatus(certificate, CERTIFICATE_READY) != "True" || conditionStatus(certificate, CERTIFICATE_ISSUING) != "False" || conditionStatus(certificate, CERTIFICATE_FAILED) != "False" {
+					t.Fatalf("Expected the certificate to be ready: %v", certificate.Status.Conditions)
+				}
+				notAfter, err := time.Parse(time.RFC3339, certificate.Status.NotAfter)
+				if err != nil || notAfter.Before(time.Now().Add(89*24*time.Hour)) {
+					t.Fatalf("Unexpected NotAfter: %s", certificate.Status.NotAfter)
+				}
+				if certificate.Status.LastError != "" || certificate.Status.Failures != nil {
+					t.Fatalf("Expected no errors: %#v", certificate.Status)
+				}
+
+				// Up to date: nothing is issued or saved, and no ACME server is
+				// contacted, not even to register with a failover server
+				failover := newFakeACMEv2Server(t)
+				defer failover.server.Close()
+				defer os.Setenv("CA_SERVERS", os.Getenv("CA_SERVERS"))
+				os.Setenv("CA_SERVERS", failover.server.URL+"/directory,"+acmeServer.server.URL+"/directory")
+				acmeServer.Lock()
+				requests := len(acmeServer.requests)
+				acmeServer.Unlock()
+				certificate, err = reconcile()
+				if err != nil || len(fake.statuses) != 2 {
+					t.Fatalf("Expected the certificate to be left alone: %v %d", err, len(fake.statuses))
+				}
+				if len(acmeServer.requests) != requests || len(failover.requests) != 0 {
+					t.Fatalf("Expected no ACME requests: %v %v", acmeServer.requests[requests:], failover.requests)
+				}
+				os.Setenv("CA_SERVERS", "")
+
+				// A domain fails validation: Failed with the error of the domain
+				acmeServer.failing["fail.example.com"] = true
+				editSpec(func(spec *CertificateSpec) {
+					spec.Domains = append(spec.Domains, "fail.example.com")
+				})
+				certificate, err = reconcile()
+				if _, ok := err.(ObtainError); !ok {
+					t.Fatalf("Expected the validation to fail: %v", err)
+				}
+				if conditionStatus(certificate, CERTIFICATE_READY) != "False" || conditionStatus(certificate, CERTIFICATE_FAILED) != "True" || conditionStatus(certificate, CERTIFICATE_ISSUING) != "False" {
+					t.Fatalf("Expected the certificate to have failed: %v", certificate.Status.Conditions)
+				}
+				if certificate.Status.LastError == "" || len(certificate.Status.Failures) != 1 || !strings.Contains(certificate.Status.Failures["fail.example.com"], "NXDOMAIN") {
+					t.Fatalf("Expected the failure of the domain: %#v", certificate.Status)
+				}
+
+				// A renewal fails: still Ready, but Failed. The status is saved
+				// although the certificate was changed concurrently.
+				editSpec(func(spec *CertificateSpec) {
+					spec.Domains = spec.Domains[:2]
+					spec.RenewBefore = fmt.Sprintf("%dh", 100*24)
+				})
+				acmeServer.failing["www.example.com"] = true
+				fake.conflicts = 2
+				certificate, err = reconcile()
+				if _, ok := err.(ObtainError); !ok {
+					t.Fatalf("Expected the renewal to fail: %v", err)
+				}
+				if conditionStatus(certificate, CERTIFICATE_READY) != "True" || conditionStatus(certificate, CERTIFICATE_FAILED) != "True" {
+					t.Fatalf("Expected the renewed certificate to stay ready: %v", certificate.Status.Conditions)
+				}
+				if len(certificate.Status.Failures) != 1 || certificate.Status.Failures["www.example.com"] == "" || certificate.Status.NotAfter != notAfter.Format(time.RFC3339) {
+					t.Fatalf("Expected the failure of the renewal: %#v", certificate.Status)
+				}
+
+				// Renewed
+				delete(acmeServer.failing, "www.example.com")
+				certificate, err = reconcile()
+				if err != nil || conditionStatus(certificate, CERTIFICATE_FAILED) != "False" || certificate.Status.LastError != "" || certificate.Status.Failures != nil {
+					t.Fatalf("Expected the certificate to be renewed: %v %#v", err, certificate.Status)
+				}
+			})
+		})
+	})
+	if fmt.Sprint(acmeServer.errors) != "[]" {
+		t.Fatalf("Invalid ACME requests: %v", acmeServer.errors)
+	}
+}
+
+func TestCertificateControllerInvalidSpec(t *testing.T) {
+	path := fmt.Sprintf("/apis/%s/%s/namespaces/default/certificates/example", CERTIFICATE_API_GROUP, CERTIFICATE_API_VERSION)
+	certificate := Certificate{
+		Metadata: ObjectMeta{Name: "example", Namespace: "default", ResourceVersion: "1"},
+		Spec:     CertificateSpec{SecretName: "example-tls"},
+	}
+	fake := &fakeCertificatesServer{
+		secrets:      &fakeSecretsServer{secrets: map[string]Secret{}},
+		certificates: map[string]Certificate{path: certificate},
+		// Rejects every attempt
+		conflicts: STATUS_UPDATE_ATTEMPTS,
+	}
+	controller := NewCertificateController("ops@example.com", NewCertificateClient("default"))
+	controller.certificates[certificate.String()] = certificate
+	withFakeKubernetesServer(t, fake, func() {
+		if err := controller.reconcileCertificate(certificate); err == nil {
+			t.Fatalf("Expected an error for a certificate without domains")
+		}
+		if len(fake.statuses) != 0 {
+			t.Fatalf("Expected the status not to be saved: %v", fake.statuses)
+		}
+		// Saved once the conflicts are resolved
+		if err := controller.reconcileCertificate(certificate); err == nil {
+			t.Fatalf("Expected an error for a certificate without domains")
+		}
+	})
+	if len(fake.statuses) != 1 || conditionStatus(Certificate{Status: fake.statuses[0]}, CERTIFICATE_FAILED) != "True" || fake.statuses[0].LastError == "" {
+		t.Fatalf("Expected the invalid spec to be recorded: %v", fake.statuses)
+	}
+}
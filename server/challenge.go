@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/xenolf/lego/acme"
+	dnsproviders "github.com/xenolf/lego/providers/dns"
+	"github.com/xenolf/lego/providers/http/webroot"
+)
+
+const (
+	HTTP_01_CHALLENGE = "http-01"
+	DNS_01_CHALLENGE  = "dns-01"
+)
+
+// setChallengeProvider configures the client to solve only the given
+// challenge type
+func setChallengeProvider(client ACMEClient, challengeType string, dnsProvider string) error {
+	switch challengeType {
+	case HTTP_01_CHALLENGE:
+		log.Printf("Setting webroot provider at %s", WEBROOT_LOCATION)
+		provider, err := webroot.NewHTTPProvider(WEBROOT_LOCATION)
+		if err != nil {
+			log.Printf("Error creating acme client provider: %s", err)
+			return err
+		}
+		log.Printf("Setting challenge provider to HTTP")
+		client.SetChallengeProvider(acme.HTTP01, provider)
+		log.Printf("Excluding all other challenges")
+		client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01})
+	case DNS_01_CHALLENGE:
+		provider, err := newDNSProvider(dnsProvider)
+		if err != nil {
+			return err
+		}
+		log.Printf("Setting challenge provider to DNS")
+		client.SetChallengeProvider(acme.DNS01, provider)
+		log.Printf("Excluding all other challenges")
+		client.ExcludeChallenges([]acme.Challenge{acme.HTTP01, acme.TLSSNI01})
+	default:
+		return configError("Unknown challenge type %s (Expected `%s` or `%s`)", challengeType, HTTP_01_CHALLENGE, DNS_01_CHALLENGE)
+	}
+	return nil
+}
+
+// newDNSProvider returns the lego DNS provider with the given name (e.g.
+// `DNS_PROVIDER`). Each provider reads its own credentials from the
+// environment (e.g. `CLOUDFLARE_EMAIL`, `RFC2136_NAMESERVER`).
+func newDNSProvider(providerName string) (acme.ChallengeProvider, error) {
+	if providerName == "" {
+		return nil, configError("A DNS provider (`DNS_PROVIDER`) is required for the %s challenge", DNS_01_CHALLENGE)
+	}
+	log.Printf("Setting DNS provider: %s", providerName)
+	provider, err := dnsproviders.NewDNSChallengeProviderByName(providerName)
+	if err != nil {
+		log.Printf("Error creating DNS provider: %s", err)
+		return nil, err
+	}
+	resolvers := Getenv("DNS_RESOLVERS", "")
+	if resolvers != "" {
+		acme.RecursiveNameservers = parseResolvers(resolvers)
+		acme.PreCheckDNS = checkDNSResolvers
+		log.Printf("Checking DNS propagation against: %s", acme.RecursiveNameservers)
+	}
+	return provider, nil
+}
+
+func parseResolvers(resolversRaw string) []string {
+	resolvers := []string{}
+	for _, resolver := range strings.Split(resolversRaw, ",") {
+		resolver = strings.Trim(resolver, " ")
+		if resolver == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return resolvers
+}
+
+// checkDNSResolvers checks that every resolver in `DNS_RESOLVERS` returns the
+// challenge record. It replaces lego's check against the authoritative
+// nameservers, which can't be reached when testing against a local server.
+func checkDNSResolvers(fqdn, value string) (bool, error) {
+	client := &dns.Client{Net: "udp", Timeout: acme.DNSTimeout}
+	for _, resolver := range acme.RecursiveNameservers {
+		m := new(dns.Msg)
+		m.SetQuestion(fqdn, dns.TypeTXT)
+		in, _, err := client.Exchange(m, resolver)
+		if err != nil {
+			return false, err
+		}
+		found := false
+		for _, rr := range in.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+				found = true
+			}
+		}
+		if !found {
+			return false, fmt.Errorf("Resolver %s did not return the expected TXT record for %s", resolver, fqdn)
+		}
+	}
+	return true, nil
+}
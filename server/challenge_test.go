@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xenolf/lego/acme"
+)
+
+// rfc2136Server is a minimal nameserver for `example.com.` which accepts
+// dynamic updates and serves the TXT records it was sent
+type rfc2136Server struct {
+	sync.Mutex
+	records map[string][]string
+}
+
+func (s *rfc2136Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if r.Opcode == dns.OpcodeUpdate {
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			switch txt.Hdr.Class {
+			case dns.ClassINET:
+				s.records[txt.Hdr.Name] = txt.Txt
+			case dns.ClassANY, dns.ClassNONE:
+				delete(s.records, txt.Hdr.Name)
+			}
+		}
+		w.WriteMsg(m)
+		return
+	}
+	question := r.Question[0]
+	switch {
+	case question.Qtype == dns.TypeSOA && question.Name == "example.com.":
+		soa, _ := dns.NewRR("example.com. 120 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 120")
+		m.Answer = append(m.Answer, soa)
+	case question.Qtype == dns.TypeTXT:
+		if txt, ok := s.records[question.Name]; ok {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 120},
+				Txt: txt,
+			})
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func startRFC2136Server(t *testing.T) (*dns.Server, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting DNS server: %s", err)
+	}
+	started := make(chan bool)
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           &rfc2136Server{records: make(map[string][]string)},
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	return server, pc.LocalAddr().String()
+}
+
+func TestDNSProviderAgainstLocalRFC2136Server(t *testing.T) {
+	server, address := startRFC2136Server(t)
+	defer server.Shutdown()
+	defer acme.ClearFqdnCache()
+	preCheckDNS, recursiveNameservers := acme.PreCheckDNS, acme.RecursiveNameservers
+	defer func() {
+		acme.PreCheckDNS, acme.RecursiveNameservers = preCheckDNS, recursiveNameservers
+	}()
+	os.Setenv("RFC2136_NAMESERVER", address)
+	os.Setenv("DNS_RESOLVERS", address)
+	defer os.Unsetenv("RFC2136_NAMESERVER")
+	defer os.Unsetenv("DNS_RESOLVERS")
+
+	provider, err := newDNSProvider("rfc2136")
+	if err != nil {
+		t.Fatalf("Error creating DNS provider: %s", err)
+	}
+	domain, token, keyAuth := "test.example.com", "token", "token.thumbprint"
+	fqdn, value, _ := acme.DNS01Record(domain, keyAuth)
+	err = provider.Present(domain, token, keyAuth)
+	if err != nil {
+		t.Fatalf("Error presenting challenge: %s", err)
+	}
+	found, err := acme.PreCheckDNS(fqdn, value)
+	if err != nil || !found {
+		t.Fatalf("Challenge record not found after presenting it: %s", err)
+	}
+	err = provider.CleanUp(domain, token, keyAuth)
+	if err != nil {
+		t.Fatalf("Error cleaning up challenge: %s", err)
+	}
+	found, _ = acme.PreCheckDNS(fqdn, value)
+	if found {
+		t.Fatalf("Challenge record still found after cleaning it up")
+	}
+}
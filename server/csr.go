@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Kinds of resources a CSR can be read from
+const (
+	CSR_SOURCE_SECRET     = "secret"
+	CSR_SOURCE_CONFIG_MAP = "configmap"
+)
+
+var DEFAULT_CSR_KEY = "tls.csr"
+
+// CSRSource is the key of a secret or config map holding a PEM encoded CSR.
+// Certificates of targets with a CSR source are issued for the CSR, so their
+// private key never leaves wherever the CSR was generated.
+type CSRSource struct {
+	Kind string
+	Name string
+	Key  string
+}
+
+func (s CSRSource) String() string {
+	return fmt.Sprintf("%s/%s (%s)", s.Kind, s.Name, s.Key)
+}
+
+// parseCSRSource parses `secret/<name>` or `configmap/<name>`. An empty value
+// returns nil, and an empty key falls back to `tls.csr`.
+func parseCSRSource(value string, key string) (*CSRSource, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != CSR_SOURCE_SECRET && parts[0] != CSR_SOURCE_CONFIG_MAP) {
+		return nil, configError("Invalid CSR source %s (Expected `%s/<name>` or `%s/<name>`)", value, CSR_SOURCE_SECRET, CSR_SOURCE_CONFIG_MAP)
+	}
+	if key == "" {
+		key = DEFAULT_CSR_KEY
+	}
+	return &CSRSource{Kind: parts[0], Name: parts[1], Key: key}, nil
+}
+
+// envCSRSource returns the CSR source set with `CSR_SOURCE` and `CSR_KEY`
+func envCSRSource() (*CSRSource, error) {
+	return parseCSRSource(Getenv("CSR_SOURCE", ""), Getenv("CSR_KEY", ""))
+}
+
+// loadCSR reads the CSR of the target from its source in the namespace of the
+// target. The CSR must be signed by its key and request exactly the domains of
+// the target.
+func loadCSR(target CertificateTarget) (*x509.CertificateRequest, error) {
+	source := target.CSR
+	var data map[string][]byte
+	var err error
+	if source.Kind == CSR_SOURCE_CONFIG_MAP {
+		data, err = getConfigMap(target.Namespace, source.Name)
+	} else {
+		data, err = getNamespacedSecret(target.Namespace, source.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data[source.Key]) == 0 {
+		return nil, fmt.Errorf("No CSR found in %s", source)
+	}
+	csr, err := parseCSR(data[source.Key])
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the CSR in %s: %s", source, err)
+	}
+	domains := csrDomains(csr)
+	if !sameDomains(domains, target.Domains) {
+		return nil, fmt.Errorf("The CSR in %s is for %s instead of %s", source, domains, target.Domains)
+	}
+	return csr, nil
+}
+
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM block found")
+	}
+	if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("Unexpected PEM block `%s`", block.Type)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSR signature: %s", err)
+	}
+	return csr, nil
+}
+
+// csrDomains returns the domains the certificate for the CSR is issued for,
+// in the order `ObtainCertificateForCSR` uses: the common name first, then
+// the SANs
+func csrDomains(csr *x509.CertificateRequest) []string {
+	domains := []string{}
+	if csr.Subject.CommonName != "" {
+		domains = append(domains, csr.Subject.CommonName)
+	}
+	for _, name := range csr.DNSNames {
+		if name != csr.Subject.CommonName {
+			domains = append(domains, name)
+		}
+	}
+	return domains
+}
+
+func sameDomains(a []string, b []string) bool {
+	domains := make(map[string]bool)
+	for _, domain := range a {
+		domains[domain] = true
+	}
+	for _, domain := range b {
+		if !domains[domain] {
+			return false
+		}
+	}
+	return len(domains) == len(b)
+}
+
+// certificateMatchesCSR returns whether the certificate was issued for the
+// key of the CSR. A new CSR (e.g. after the key was rotated) requires a new
+// certificate.
+func certificateMatchesCSR(certificate []byte, csr *x509.CertificateRequest) bool {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return false
+	}
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	csrKey, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(certKey, csrKey)
+}
+
+// obtainCertificateForCSR obtains a certificate for the CSR of the target.
+// The certificate and its issuer are stored without a private key.
+func obtainCertificateForCSR(target CertificateTarget, email string) (acme.CertificateResource, error) {
+	csr, err := loadCSR(target)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+	err = prepareSecret(target)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+	legoUser, err := getUserWithRegistration(email)
+	if err != nil {
+		log.Printf("Error getting user with registration: %s", err)
+		return acme.CertificateResource{}, err
+	}
+	client, err := newAcmeClient(legoUser, target)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+	bundle := false
+	log.Printf("Obtaining certificates for the CSR in %s...", target.CSR)
+	certificates, failures := client.ObtainCertificateForCSR(*csr, bundle)
+	if len(failures) > 0 {
+		log.Printf("Too many failures: %s", failures)
+		return acme.CertificateResource{}, ObtainError{Failures: failures}
+	}
+	return certificates, saveCertificates(target, certificates)
+}
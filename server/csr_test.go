@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// testCSR returns a PEM encoded CSR for the domains and its key
+func testCSR(t *testing.T, domains []string) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatalf("Error creating CSR: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), key
+}
+
+func TestParseCSRSource(t *testing.T) {
+	source, err := parseCSRSource("configmap/example-csr", "")
+	if err != nil || *source != (CSRSource{Kind: CSR_SOURCE_CONFIG_MAP, Name: "example-csr", Key: "tls.csr"}) {
+		t.Fatalf("Unexpected source: %v %v", source, err)
+	}
+	source, err = parseCSRSource("secret/example-csr", "request.pem")
+	if err != nil || *source != (CSRSource{Kind: CSR_SOURCE_SECRET, Name: "example-csr", Key: "request.pem"}) {
+		t.Fatalf("Unexpected source: %v %v", source, err)
+	}
+	if source, err := parseCSRSource("", ""); source != nil || err != nil {
+		t.Fatalf("Expected no source: %v %v", source, err)
+	}
+	for _, value := range []string{"example-csr", "pod/example-csr", "secret/"} {
+		if _, err := parseCSRSource(value, ""); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestLoadCSR(t *testing.T) {
+	csr, _ := testCSR(t, []string{"example.com", "www.example.com"})
+	fake := &fakeSecretsServer{
+		secrets: map[string]Secret{
+			"/api/v1/namespaces/default/secrets/example-csr": {
+				Data: map[string]string{"tls.csr": base64.StdEncoding.EncodeToString(csr)},
+			},
+			// Config maps are returned the same way, but with plain data
+			"/api/v1/namespaces/default/configmaps/example-csr": {
+				Data: map[string]string{"request.pem": string(csr)},
+			},
+		},
+	}
+	withFakeSecretsServer(t, fake, func() {
+		target := CertificateTarget{
+			Namespace: "default",
+			Domains:   []string{"www.example.com", "example.com"},
+			CSR:       &CSRSource{Kind: CSR_SOURCE_SECRET, Name: "example-csr", Key: "tls.csr"},
+		}
+		parsed, err := loadCSR(target)
+		if err != nil || parsed.Subject.CommonName != "example.com" {
+			t.Fatalf("Error loading CSR from secret: %v", err)
+		}
+
+		target.CSR = &CSRSource{Kind: CSR_SOURCE_CONFIG_MAP, Name: "example-csr", Key: "request.pem"}
+		if _, err := loadCSR(target); err != nil {
+			t.Fatalf("Error loading CSR from config map: %s", err)
+		}
+
+		target.Domains = []string{"example.com"}
+		if _, err := loadCSR(target); err == nil {
+			t.Fatalf("Expected an error for different domains")
+		}
+		target.CSR.Key = "tls.csr"
+		if _, err := loadCSR(target); err == nil {
+			t.Fatalf("Expected an error for a missing key")
+		}
+	})
+}
+
+func TestCertificateMatchesCSR(t *testing.T) {
+	csrPem, key := testCSR(t, []string{"example.com"})
+	csr, err := parseCSR(csrPem)
+	if err != nil {
+		t.Fatalf("Error parsing CSR: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if !certificateMatchesCSR(certificate, csr) {
+		t.Fatalf("Expected the certificate to match the CSR")
+	}
+	other, _ := selfSignedCertificate(t, []string{"example.com"}, time.Now().Add(time.Hour))
+	if certificateMatchesCSR(other, csr) {
+		t.Fatalf("Expected a certificate for another key not to match the CSR")
+	}
+}
+
+func TestCertificateSecretDataWithoutPrivateKey(t *testing.T) {
+	certificates := acme.CertificateResource{
+		Domain:            "example.com",
+		Certificate:       []byte(testCertificate),
+		IssuerCertificate: []byte(testIssuerCertificate),
+	}
+	target := CertificateTarget{Domains: []string{"example.com"}, Layout: SECRET_LAYOUT_TLS, LegacyKeys: true}
+	data, err := certificateSecretData(target, certificates)
+	if err != nil {
+		t.Fatalf("Error building secret data: %s", err)
+	}
+	if data["tls.crt"] == "" || data["example.com.crt"] == "" {
+		t.Fatalf("Expected the certificate to be written: %v", data)
+	}
+	for _, key := range []string{"tls.key", "example.com.key", "example.com.pem"} {
+		if value, ok := data[key]; !ok || value != "" {
+			t.Errorf("Expected `%s` to be cleared: %q", key, value)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// Keys of the External Account Binding credentials in `EAB_SECRET_NAME`,
+// which defaults to the account secret. The credentials of each ACME server
+// but the first are followed by the suffix of its account keys.
+var EAB_KEY_ID_KEY = "eab_key_id"
+var EAB_HMAC_KEY_KEY = "eab_hmac_key"
+
+const ACME_ACCOUNT_DOES_NOT_EXIST_ERROR = "urn:ietf:params:acme:error:accountDoesNotExist"
+
+// ExternalAccountBinding holds the credentials of an account with the CA that
+// new ACME accounts are bound to (RFC 8555 section 7.3.4). CAs like ZeroSSL,
+// Google Trust Services or step-ca require it to register.
+type ExternalAccountBinding struct {
+	KeyID   string
+	HMACKey []byte
+}
+
+// loadExternalAccountBinding returns the credentials stored in
+// `EAB_SECRET_NAME`, or nil if there are none
+func loadExternalAccountBinding() (*ExternalAccountBinding, error) {
+	secretName := Getenv("EAB_SECRET_NAME", Getenv("LETS_ENCRYPT_USER_SECRET_NAME", ""))
+	if secretName == "" {
+		return nil, nil
+	}
+	namespace, err := getNamespace()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := lookupSecret(namespace, secretName)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	suffix := accountKeySuffix(caServer())
+	keyIDKey, hmacKeyKey := EAB_KEY_ID_KEY+suffix, EAB_HMAC_KEY_KEY+suffix
+	keyID, err := base64.StdEncoding.DecodeString(secret.Data[keyIDKey])
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding key `%s` in secret `%s`: %s", keyIDKey, secretName, err)
+	}
+	hmacKey, err := base64.StdEncoding.DecodeString(secret.Data[hmacKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding key `%s` in secret `%s`: %s", hmacKeyKey, secretName, err)
+	}
+	if len(keyID) == 0 && len(hmacKey) == 0 {
+		return nil, nil
+	}
+	if len(keyID) == 0 || len(hmacKey) == 0 {
+		return nil, configError("Secret `%s` needs both `%s` and `%s` for External Account Binding", secretName, keyIDKey, hmacKeyKey)
+	}
+	binding := &ExternalAccountBinding{KeyID: strings.TrimSpace(string(keyID))}
+	binding.HMACKey, err = parseHMACKey(string(hmacKey))
+	if err != nil {
+		return nil, configError("Error parsing key `%s` in secret `%s`: %s", hmacKeyKey, secretName, err)
+	}
+	return binding, nil
+}
+
+// parseHMACKey decodes the HMAC key, which CAs hand out base64url encoded
+// (with or without padding)
+func parseHMACKey(value string) ([]byte, error) {
+	value = strings.TrimRight(strings.TrimSpace(value), "=")
+	key, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		key, err = base64.RawStdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid HMAC key (Expected base64url): %s", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Empty HMAC key")
+	}
+	return key, nil
+}
+
+// sign returns the `externalAccountBinding` of a new account request to the
+// URL: the public account key signed with the HMAC key (HS256)
+func (b ExternalAccountBinding) sign(accountKey crypto.PrivateKey, url string) (map[string]string, error) {
+	publicKey, err := accountPublicKey(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	jwk, err := json.Marshal(jose.JsonWebKey{Key: publicKey})
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "kid": b.KeyID, "url": url})
+	if err != nil {
+		return nil, err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	payload := base64.RawURLEncoding.EncodeToString(jwk)
+	mac := hmac.New(sha256.New, b.HMACKey)
+	mac.Write([]byte(protected + "." + payload))
+	return map[string]string{
+		"protected": protected,
+		"payload":   payload,
+		"signature": base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+	}, nil
+}
+
+// registerBoundAccount registers the account of the client, binding it to the
+// external account. If the key was bound before (`boundKeyID`) its account is
+// looked up instead, so it isn't bound again. It returns whether the binding
+// was sent, as only then the account is bound to `binding`.
+func registerBoundAccount(client *ACMEv2Client, contact []string, binding *ExternalAccountBinding, boundKeyID string) (ACMEv2Account, bool, error) {
+	if boundKeyID != "" {
+		account, err := client.FindAccount()
+		if remoteErr, ok := err.(acme.RemoteError); !ok || remoteErr.Type != ACME_ACCOUNT_DOES_NOT_EXIST_ERROR {
+			return account, false, err
+		}
+		log.Printf("The account bound to `%s` doesn't exist anymore", boundKeyID)
+	}
+	if binding == nil && client.directory.Meta.ExternalAccountRequired {
+		suffix := accountKeySuffix(caServer())
+		return ACMEv2Account{}, false, fmt.Errorf("The ACME server requires External Account Binding. Store `%s` and `%s` in the account secret or the secret `EAB_SECRET_NAME`", EAB_KEY_ID_KEY+suffix, EAB_HMAC_KEY_KEY+suffix)
+	}
+	account, err := client.Register(contact, binding)
+	return account, binding != nil && err == nil, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseHMACKey(t *testing.T) {
+	key := []byte{0xfb, 0xff, 0x01, 0x02, 0x03}
+	for _, value := range []string{
+		base64.RawURLEncoding.EncodeToString(key),
+		base64.URLEncoding.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(key) + "\n",
+	} {
+		parsed, err := parseHMACKey(value)
+		if err != nil || string(parsed) != string(key) {
+			t.Errorf("Unexpected key for %s: %x %v", value, parsed, err)
+		}
+	}
+	for _, value := range []string{"", "not base64!"} {
+		if _, err := parseHMACKey(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+	fake := newFakeACMEv2Server(t)
+	fake.eab = map[string][]byte{"kid-1": hmacKey, "kid-2": hmacKey}
+	secrets := fakeAccountSecrets(t, "")
+	path := "/api/v1/namespaces/default/secrets/lets-encrypt-user"
+	withFakeACMEv2Server(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			_, err := ensureRegistration("ops@example.com")
+			if err == nil || !strings.Contains(err.Error(), "External Account Binding") {
+				t.Fatalf("Expected the registration to require External Account Binding: %v", err)
+			}
+
+			secret := secrets.secrets[path]
+			secret.Data[EAB_KEY_ID_KEY] = base64.StdEncoding.EncodeToString([]byte("kid-1"))
+			secret.Data[EAB_HMAC_KEY_KEY] = base64.StdEncoding.EncodeToString([]byte(base64.RawURLEncoding.EncodeToString(hmacKey)))
+			secrets.secrets[path] = secret
+			user, err := ensureRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error registering user: %s", err)
+			}
+			if user.Registration.URI != fake.server.URL+"/acct/1" || len(fake.bindings) != 1 || fake.bindings[0] != "kid-1" {
+				t.Fatalf("Expected the account to be bound: %#v %v", user.Registration, fake.bindings)
+			}
+			keyID, err := getStateStore().LoadExternalAccountKeyID()
+			if err != nil || keyID != "kid-1" {
+				t.Fatalf("Expected the binding to be recorded: %s %v", keyID, err)
+			}
+
+			// The stored registration is reused
+			if _, err = ensureRegistration("ops@example.com"); err != nil {
+				t.Fatalf("Error ensuring registration: %s", err)
+			}
+			// Without a registration the bound account is looked up
+			secret = secrets.secrets[path]
+			secret.Data["registration"] = ""
+			secrets.secrets[path] = secret
+			user, err = ensureRegistration("ops@example.com")
+			if err != nil || user.Registration.URI != fake.server.URL+"/acct/1" {
+				t.Fatalf("Expected the bound account to be found: %#v %v", user.Registration, err)
+			}
+
+			// New credentials don't rebind the existing account
+			secret = secrets.secrets[path]
+			secret.Data[EAB_KEY_ID_KEY] = base64.StdEncoding.EncodeToString([]byte("kid-2"))
+			secret.Data["registration"] = ""
+			secrets.secrets[path] = secret
+			user, err = ensureRegistration("ops@example.com")
+			if err != nil || user.Registration.URI != fake.server.URL+"/acct/1" {
+				t.Fatalf("Expected the bound account to be found: %#v %v", user.Registration, err)
+			}
+			keyID, err = getStateStore().LoadExternalAccountKeyID()
+			if err != nil || keyID != "kid-1" {
+				t.Fatalf("Expected the existing binding to be kept: %s %v", keyID, err)
+			}
+		})
+	})
+	if len(fake.bindings) != 1 {
+		t.Fatalf("Expected the account to be bound once: %v", fake.bindings)
+	}
+	// Registered and then looked up twice. Without credentials nothing is sent.
+	if fake.count("POST /new-account") != 3 {
+		t.Fatalf("Unexpected requests: %v", fake.requests)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Annotation recording the directory of the ACME server that issued the
+// certificate in a secret
+var CA_SERVER_ANNOTATION = "auto-kubernetes-lets-encrypt/ca-server"
+
+// Directory of the ACME server requests go to while failing over to one of
+// `CA_SERVERS`. Empty for the first one.
+var ACTIVE_CA_SERVER = ""
+
+// CAUnavailableError is returned when the ACME server can't be reached or
+// doesn't respond
+type CAUnavailableError struct {
+	URL string
+	Err error
+}
+
+func (e CAUnavailableError) Error() string {
+	return fmt.Sprintf("Error reaching %s: %s", e.URL, e.Err)
+}
+
+// caServers returns the directories of `CA_SERVERS` in the order they're
+// tried, or the one of `CA_SERVER`
+func caServers() []string {
+	servers := []string{}
+	for _, server := range strings.Split(Getenv("CA_SERVERS", ""), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, Getenv("CA_SERVER", "https://acme-v02.api.letsencrypt.org/directory"))
+	}
+	return servers
+}
+
+// accountKeySuffix returns the suffix of the account secret keys holding the
+// account of the ACME server, e.g. `.acme.zerossl.com_v2_DV90`. The account
+// of the first of `caServers()` is stored without a suffix.
+func accountKeySuffix(directoryURL string) string {
+	if directoryURL == caServers()[0] {
+		return ""
+	}
+	name := directoryURL
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	return "." + strings.Trim(name, "._")
+}
+
+// failoverError returns whether the error is an outage of the ACME server or a
+// rate limit, so the certificate can be issued by the next one
+func failoverError(err error) bool {
+	switch err := err.(type) {
+	case CAUnavailableError:
+		return true
+	case ObtainError:
+		for _, failure := range err.Failures {
+			if failoverError(failure) {
+				return true
+			}
+		}
+		return false
+	}
+	remoteErr, ok := remoteError(err)
+	return ok && (rateLimited(remoteErr) || serverError(remoteErr))
+}
+
+// issueWithFailover issues the certificate of the target with each of
+// `caServers()` in turn until one doesn't fail with an outage or rate limit.
+// The ACME server that issued the stored certificate is tried first.
+func issueWithFailover(target CertificateTarget, email string, issueCert func(target CertificateTarget, email string) (acme.CertificateResource, error)) (acme.CertificateResource, error) {
+	servers := caServers()
+	if len(servers) == 1 {
+		return issueCert(target, email)
+	}
+	defer func() {
+		ACTIVE_CA_SERVER = ""
+	}()
+	var certificates acme.CertificateResource
+	var err error
+	for i, server := range failoverOrder(target, servers) {
+		if i > 0 {
+			log.Printf("Failing over to %s", server)
+		}
+		ACTIVE_CA_SERVER = server
+		certificates, err = issueWithCAServer(target, email, issueCert)
+		if err == nil || !failoverError(err) {
+			return certificates, err
+		}
+		log.Printf("ACME server %s is unavailable or rate limited: %s", server, err)
+	}
+	return certificates, err
+}
+
+// issueWithCAServer issues the certificate with the active ACME server,
+// registering its account first if there is none yet
+func issueWithCAServer(target CertificateTarget, email string, issueCert func(target CertificateTarget, email string) (acme.CertificateResource, error)) (acme.CertificateResource, error) {
+	registration, err := getStateStore().LoadRegistration()
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+	if registration == nil {
+		log.Printf("No account for %s yet", caServer())
+		_, err = ensureRegistration(email)
+		if err != nil {
+			return acme.CertificateResource{}, err
+		}
+	}
+	return issueCert(target, email)
+}
+
+// failoverOrder returns the ACME servers with the one that issued the stored
+// certificate of the target first
+func failoverOrder(target CertificateTarget, servers []string) []string {
+	issuer := loadIssuingCAServer(target)
+	ordered := []string{}
+	for _, server := range servers {
+		if server == issuer {
+			log.Printf("Certificate in secret `%s` was issued by %s", target.SecretName, issuer)
+			ordered = append(ordered, server)
+		}
+	}
+	for _, server := range servers {
+		if server != issuer {
+			ordered = append(ordered, server)
+		}
+	}
+	return ordered
+}
+
+// loadIssuingCAServer returns the ACME server recorded on the secret of the
+// target, or "" if there is none
+func loadIssuingCAServer(target CertificateTarget) string {
+	secret, err := lookupSecret(target.Namespace, target.SecretName)
+	if err != nil || secret == nil {
+		return ""
+	}
+	return secret.Metadata.Annotations[CA_SERVER_ANNOTATION]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestAccountKeySuffix(t *testing.T) {
+	defer os.Setenv("CA_SERVERS", os.Getenv("CA_SERVERS"))
+	os.Setenv("CA_SERVERS", " https://acme-v02.api.letsencrypt.org/directory, https://acme.zerossl.com/v2/DV90 ,")
+	if servers := caServers(); len(servers) != 2 || servers[1] != "https://acme.zerossl.com/v2/DV90" {
+		t.Fatalf("Unexpected CA servers: %v", servers)
+	}
+	if suffix := accountKeySuffix("https://acme-v02.api.letsencrypt.org/directory"); suffix != "" {
+		t.Fatalf("Expected no suffix for the first CA server: %s", suffix)
+	}
+	if suffix := accountKeySuffix("https://acme.zerossl.com/v2/DV90"); suffix != ".acme.zerossl.com_v2_DV90" {
+		t.Fatalf("Unexpected suffix: %s", suffix)
+	}
+}
+
+func TestFailoverError(t *testing.T) {
+	for _, err := range []error{
+		CAUnavailableError{URL: "https://acme.example.com/directory", Err: &url.Error{Op: "Get", Err: errors.New("connection refused")}},
+		acme.RemoteError{StatusCode: 429, Type: "urn:ietf:params:acme:error:rateLimited"},
+		acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:rateLimited"},
+		acme.RemoteError{StatusCode: 503},
+		ObtainError{Failures: map[string]error{"example.com": acme.RemoteError{StatusCode: 500, Type: "urn:ietf:params:acme:error:serverInternal"}}},
+	} {
+		if !failoverError(err) {
+			t.Errorf("Expected to fail over for %#v", err)
+		}
+	}
+	for _, err := range []error{
+		errors.New("Secret `example-tls` not found"),
+		acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized"},
+		ObtainError{Failures: map[string]error{"example.com": acme.RemoteError{StatusCode: 400, Type: "urn:ietf:params:acme:error:dns"}}},
+	} {
+		if failoverError(err) {
+			t.Errorf("Expected not to fail over for %#v", err)
+		}
+	}
+}
+
+func TestIssueWithFailover(t *testing.T) {
+	backup := newFakeACMEv2Server(t)
+	// The first CA server is down. Only it has an account yet.
+	primary := "http://127.0.0.1:1/directory"
+	secrets := fakeAccountSecrets(t, `{"uri": "http://127.0.0.1:1/acct/1"}`)
+	secrets.secrets["/api/v1/namespaces/default/secrets/example-tls"] = Secret{
+		Metadata: ObjectMeta{Name: "example-tls", Namespace: "default"},
+		Type:     SECRET_TYPE_TLS,
+	}
+	target := CertificateTarget{Namespace: "default", SecretName: "example-tls", Domains: []string{"example.com"}, Layout: SECRET_LAYOUT_TLS}
+	certificate, key := selfSignedCertificate(t, target.Domains, time.Now().Add(time.Hour))
+
+	issuedBy := []string{}
+	var backupErr error
+	issueCert := func(target CertificateTarget, email string) (acme.CertificateResource, error) {
+		issuedBy = append(issuedBy, caServer())
+		if caServer() == primary {
+			return acme.CertificateResource{}, CAUnavailableError{URL: primary, Err: errors.New("connection refused")}
+		}
+		if backupErr != nil {
+			return acme.CertificateResource{}, backupErr
+		}
+		certificates := acme.CertificateResource{Domain: "example.com", Certificate: certificate, PrivateKey: key}
+		return certificates, saveCertificates(target, certificates)
+	}
+
+	withFakeACMEv2Server(t, backup, func() {
+		defer os.Setenv("CA_SERVERS", os.Getenv("CA_SERVERS"))
+		os.Setenv("CA_SERVERS", primary+","+backup.server.URL+"/directory")
+		withFakeSecretsServer(t, secrets, func() {
+			_, err := issueWithFailover(target, "ops@example.com", issueCert)
+			if err != nil {
+				t.Fatalf("Error issuing certificate: %s", err)
+			}
+			if len(issuedBy) != 2 || issuedBy[1] != backup.server.URL+"/directory" {
+				t.Fatalf("Expected the backup CA server to issue the certificate: %v", issuedBy)
+			}
+			if caServer() != primary {
+				t.Fatalf("Expected the first CA server to be active again: %s", caServer())
+			}
+			// The backup CA server got an account of its own
+			suffix := accountKeySuffix(backup.server.URL + "/directory")
+			account := secrets.secrets["/api/v1/namespaces/default/secrets/lets-encrypt-user"].Data
+			if account["registration"+suffix] == "" || account["private_key"+suffix] == "" || account["private_key"+suffix] == account["private_key"] {
+				t.Fatalf("Expected an account for the backup CA server: %v", keys(account))
+			}
+			annotations := secrets.secrets["/api/v1/namespaces/default/secrets/example-tls"].Metadata.Annotations
+			if annotations[CA_SERVER_ANNOTATION] != backup.server.URL+"/directory" {
+				t.Fatalf("Expected the issuing CA server to be recorded: %v", annotations)
+			}
+
+			// The CA server that issued the certificate is tried first, and
+			// other errors don't fail over
+			issuedBy = nil
+			backupErr = acme.RemoteError{StatusCode: 403, Type: "urn:ietf:params:acme:error:unauthorized", Detail: "Account is deactivated"}
+			_, err = issueWithFailover(target, "ops@example.com", issueCert)
+			if err != backupErr || len(issuedBy) != 1 || issuedBy[0] != backup.server.URL+"/directory" {
+				t.Fatalf("Expected the backup CA server to fail without failing over: %v %v", issuedBy, err)
+			}
+
+			// The backup CA server is rate limited and the first one is down
+			issuedBy = nil
+			backupErr = acme.RemoteError{StatusCode: 429, Type: "urn:ietf:params:acme:error:rateLimited"}
+			_, err = issueWithFailover(target, "ops@example.com", issueCert)
+			if _, ok := err.(CAUnavailableError); !ok || len(issuedBy) != 2 {
+				t.Fatalf("Expected every CA server to be tried: %v %v", issuedBy, err)
+			}
+		})
+	})
+	if len(backup.bindings) != 0 || backup.count("POST /new-account") != 1 {
+		t.Fatalf("Expected the account to be registered once: %v", backup.requests)
+	}
+	if fmt.Sprint(backup.errors) != "[]" {
+		t.Fatalf("Invalid requests: %v", backup.errors)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// parseCertificateGroups parses `CERTIFICATES`: groups separated by `;`, each
+// a secret name and the comma separated domains of its certificate, e.g.
+// `example-tls=example.com,www.example.com;api-tls=api.example.com`
+func parseCertificateGroups(value string) ([]CertificateTarget, error) {
+	targets := []CertificateTarget{}
+	for _, group := range strings.Split(value, ";") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		parts := strings.SplitN(group, "=", 2)
+		secretName := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || secretName == "" {
+			return nil, fmt.Errorf("Invalid certificate group %s (Expected `<secret name>=<domain>,<domain>`)", group)
+		}
+		domains := splitDomains(parts[1])
+		if len(domains) == 0 {
+			return nil, fmt.Errorf("Certificate group `%s` has no domains", secretName)
+		}
+		targets = append(targets, CertificateTarget{SecretName: secretName, Domains: domains})
+	}
+	return targets, nil
+}
+
+func splitDomains(value string) []string {
+	domains := []string{}
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// envCertificateTargets returns the certificates configured through `DOMAINS`
+// and `SECRET_NAME` followed by the groups in `CERTIFICATES`, all in the
+// current namespace
+func envCertificateTargets() ([]CertificateTarget, error) {
+	targets := []CertificateTarget{}
+	if domains := splitDomains(Getenv("DOMAINS", "")); len(domains) > 0 {
+		target, err := envCertificateTarget(domains)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	groups, err := parseCertificateGroups(Getenv("CERTIFICATES", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 && len(groups) == 0 {
+		return nil, fmt.Errorf("Either `DOMAINS` and `SECRET_NAME` or `CERTIFICATES` are required")
+	}
+	namespace, err := getNamespace()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		group.Namespace = namespace
+		targets = append(targets, group)
+	}
+
+	// The TLS layout holds a single certificate, so each group needs its own
+	// secret. Legacy secrets can hold one certificate per first domain.
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		layout, err := secretLayout(target)
+		if err != nil {
+			return nil, err
+		}
+		key := target.SecretName
+		if layout == SECRET_LAYOUT_LEGACY {
+			key += "/" + target.Domains[0]
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("Secret `%s` is used by more than one certificate", target.SecretName)
+		}
+		seen[key] = true
+	}
+	return targets, nil
+}
+
+// IssueError holds the errors of the certificates that couldn't be issued
+type IssueError struct {
+	Failed []CertificateTarget
+	Errors []error
+}
+
+func (e IssueError) Error() string {
+	messages := []string{}
+	for i, target := range e.Failed {
+		messages = append(messages, fmt.Sprintf("%s in secret `%s`: %s", target.Domains, target.SecretName, e.Errors[i]))
+	}
+	return fmt.Sprintf("%d certificates could not be issued: %s", len(e.Failed), strings.Join(messages, "; "))
+}
+
+// issueTargets issues the certificate of each target on its own, so a
+// failing certificate doesn't keep the others from being issued. It returns
+// an `IssueError` with the targets that failed.
+func issueTargets(targets []CertificateTarget, email string, issueCert func(target CertificateTarget, email string) (acme.CertificateResource, error)) error {
+	issueErr := IssueError{}
+	for _, target := range targets {
+		log.Printf("Issuing certificate for %s in secret `%s`", target.Domains, target.SecretName)
+		_, err := issueCert(target, email)
+		if err != nil {
+			log.Printf("Error issuing certificate for %s in secret `%s`: %s", target.Domains, target.SecretName, err)
+			issueErr.Failed = append(issueErr.Failed, target)
+			issueErr.Errors = append(issueErr.Errors, err)
+			continue
+		}
+		log.Printf("Certificate for %s in secret `%s` is up to date", target.Domains, target.SecretName)
+	}
+	log.Printf("%d of %d certificates issued", len(targets)-len(issueErr.Failed), len(targets))
+	if len(issueErr.Failed) > 0 {
+		return issueErr
+	}
+	return nil
+}
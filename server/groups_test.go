@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestParseCertificateGroups(t *testing.T) {
+	targets, err := parseCertificateGroups(" example-tls = example.com, www.example.com ;api-tls=api.example.com;")
+	if err != nil {
+		t.Fatalf("Error parsing groups: %s", err)
+	}
+	if len(targets) != 2 || targets[0].SecretName != "example-tls" || len(targets[0].Domains) != 2 || targets[0].Domains[1] != "www.example.com" {
+		t.Fatalf("Unexpected targets: %#v", targets)
+	}
+	if targets[1].SecretName != "api-tls" || targets[1].Domains[0] != "api.example.com" {
+		t.Fatalf("Unexpected targets: %#v", targets)
+	}
+	for _, value := range []string{"example.com", "=example.com", "example-tls=", "example-tls= , "} {
+		if _, err := parseCertificateGroups(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestEnvCertificateTargets(t *testing.T) {
+	for _, key := range []string{"DOMAINS", "SECRET_NAME", "CERTIFICATES", "SECRET_LAYOUT"} {
+		defer os.Setenv(key, os.Getenv(key))
+	}
+	withFakeSecretsServer(t, &fakeSecretsServer{}, func() {
+		os.Setenv("DOMAINS", "example.com")
+		os.Setenv("SECRET_NAME", "example-certs")
+		os.Setenv("CERTIFICATES", "example-certs=example.org;api-tls=api.example.com")
+		os.Setenv("SECRET_LAYOUT", "legacy")
+		targets, err := envCertificateTargets()
+		if err != nil {
+			t.Fatalf("Error reading targets: %s", err)
+		}
+		if len(targets) != 3 || targets[0].Domains[0] != "example.com" || targets[2].SecretName != "api-tls" || targets[2].Namespace != "default" {
+			t.Fatalf("Unexpected targets: %#v", targets)
+		}
+
+		// A TLS secret holds a single certificate
+		os.Setenv("SECRET_LAYOUT", "tls")
+		if _, err := envCertificateTargets(); err == nil {
+			t.Fatalf("Expected an error for a shared TLS secret")
+		}
+
+		os.Setenv("DOMAINS", "")
+		os.Setenv("CERTIFICATES", "")
+		if _, err := envCertificateTargets(); err == nil {
+			t.Fatalf("Expected an error without certificates")
+		}
+	})
+}
+
+func TestIssueTargets(t *testing.T) {
+	targets := []CertificateTarget{
+		{SecretName: "example-tls", Domains: []string{"example.com"}},
+		{SecretName: "broken-tls", Domains: []string{"broken.example.com"}},
+		{SecretName: "api-tls", Domains: []string{"api.example.com"}},
+	}
+	issued := []string{}
+	err := issueTargets(targets, "ops@example.com", func(target CertificateTarget, email string) (acme.CertificateResource, error) {
+		if target.SecretName == "broken-tls" {
+			return acme.CertificateResource{}, errors.New("Invalid response from http://broken.example.com")
+		}
+		issued = append(issued, target.SecretName)
+		return acme.CertificateResource{}, nil
+	})
+	if len(issued) != 2 || issued[1] != "api-tls" {
+		t.Fatalf("Expected the other certificates to be issued: %v", issued)
+	}
+	issueErr, ok := err.(IssueError)
+	if !ok || len(issueErr.Failed) != 1 || issueErr.Failed[0].SecretName != "broken-tls" {
+		t.Fatalf("Expected the broken certificate to fail: %v", err)
+	}
+	if issueTargets(targets[:1], "ops@example.com", func(target CertificateTarget, email string) (acme.CertificateResource, error) {
+		return acme.CertificateResource{}, nil
+	}) != nil {
+		t.Fatalf("Expected no error")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// ImportedAccount is an account read from the directory of another ACME client
+type ImportedAccount struct {
+	Email        string
+	PrivateKey   []byte
+	Registration acme.RegistrationResource
+}
+
+// Files identifying the account directories of the supported clients
+const (
+	// certbot: /etc/letsencrypt/accounts/<server>/directory/<id>/
+	CERTBOT_REGISTRATION_FILE = "regr.json"
+	CERTBOT_PRIVATE_KEY_FILE  = "private_key.json"
+	// lego: .lego/accounts/<server>/<email>/ with the key in keys/<email>.key
+	LEGO_ACCOUNT_FILE = "account.json"
+)
+
+// runImportAccount implements the `import-account` subcommand, which stores
+// the account key and registration of a certbot or lego account in the
+// account secret
+func runImportAccount(args []string) error {
+	flags := flag.NewFlagSet("import-account", flag.ExitOnError)
+	email := flags.String("email", "", "Email of the account. Only needed if the account directory doesn't have it")
+	secretName := flags.String("secret-name", Getenv("LETS_ENCRYPT_USER_SECRET_NAME", "auto-kubernetes-lets-encrypt"), "Secret the account is stored in")
+	force := flags.Bool("force", false, "Replace a different account key already stored in the secret")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import-account [flags] <account directory>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("The account directory is required")
+	}
+
+	account, err := readAccountDirectory(flags.Arg(0), *email)
+	if err != nil {
+		return err
+	}
+	log.Printf("Importing account %s (%s) into secret `%s`", account.Registration.URI, account.Email, *secretName)
+	return importAccount(SecretStateStore{AccountSecretName: *secretName}, account, *force)
+}
+
+// importAccount stores the key and registration of the account. A different
+// key already stored is only replaced with `force`, since it belongs to
+// another account.
+func importAccount(store StateStore, account ImportedAccount, force bool) error {
+	stored, err := store.LoadOrCreateAccountKey(func() ([]byte, error) {
+		return account.PrivateKey, nil
+	})
+	if err != nil {
+		return err
+	}
+	if string(stored) != string(account.PrivateKey) {
+		if !force {
+			return errors.New("The secret already holds a different account key. Use `--force` to replace it.")
+		}
+		log.Printf("Replacing the stored account key")
+		err = store.SaveAccountKey(account.PrivateKey)
+		if err != nil {
+			return err
+		}
+	}
+	return store.SaveRegistration(account.Registration)
+}
+
+// readAccountDirectory reads the account in the directory. The directory is
+// either the account directory itself or one of its parents holding a single
+// account (e.g. `/etc/letsencrypt/accounts`).
+func readAccountDirectory(dir string, email string) (ImportedAccount, error) {
+	accountDirs := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (info.Name() == CERTBOT_REGISTRATION_FILE || info.Name() == LEGO_ACCOUNT_FILE) {
+			accountDirs = append(accountDirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportedAccount{}, err
+	}
+	if len(accountDirs) == 0 {
+		return ImportedAccount{}, fmt.Errorf("No certbot (`%s`) or lego (`%s`) account found in %s", CERTBOT_REGISTRATION_FILE, LEGO_ACCOUNT_FILE, dir)
+	}
+	if len(accountDirs) > 1 {
+		return ImportedAccount{}, fmt.Errorf("Found %d accounts in %s. Pass the directory of one of them: %s", len(accountDirs), dir, strings.Join(accountDirs, ", "))
+	}
+
+	var account ImportedAccount
+	var key crypto.PrivateKey
+	if _, err := os.Stat(filepath.Join(accountDirs[0], LEGO_ACCOUNT_FILE)); err == nil {
+		account, key, err = readLegoAccount(accountDirs[0])
+		if err != nil {
+			return account, err
+		}
+	} else {
+		account, key, err = readCertbotAccount(accountDirs[0])
+		if err != nil {
+			return account, err
+		}
+	}
+	if email != "" {
+		account.Email = email
+	}
+	return completeImportedAccount(account, key)
+}
+
+// readLegoAccount reads `account.json` and the key in `keys/<email>.key`
+func readLegoAccount(dir string) (ImportedAccount, crypto.PrivateKey, error) {
+	log.Printf("Reading lego account from %s", dir)
+	account := ImportedAccount{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, LEGO_ACCOUNT_FILE))
+	if err != nil {
+		return account, nil, err
+	}
+	legoAccount := struct {
+		Email        string                     `json:"email"`
+		Registration *acme.RegistrationResource `json:"registration"`
+	}{}
+	err = json.Unmarshal(data, &legoAccount)
+	if err != nil {
+		return account, nil, fmt.Errorf("Error parsing %s: %s", LEGO_ACCOUNT_FILE, err)
+	}
+	if legoAccount.Registration == nil {
+		return account, nil, fmt.Errorf("No registration in %s", LEGO_ACCOUNT_FILE)
+	}
+	account.Email = legoAccount.Email
+	account.Registration = *legoAccount.Registration
+
+	keyPath := filepath.Join(dir, "keys", legoAccount.Email+".key")
+	pemKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return account, nil, fmt.Errorf("Error reading the account key: %s", err)
+	}
+	key, err := parseAccountKey(pemKey)
+	if err != nil {
+		return account, nil, fmt.Errorf("Error reading the account key %s: %s", keyPath, err)
+	}
+	return account, key, nil
+}
+
+// readCertbotAccount reads `regr.json` and the JWK in `private_key.json`.
+// `regr.json` is already a registration resource.
+func readCertbotAccount(dir string) (ImportedAccount, crypto.PrivateKey, error) {
+	log.Printf("Reading certbot account from %s", dir)
+	account := ImportedAccount{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, CERTBOT_REGISTRATION_FILE))
+	if err != nil {
+		return account, nil, err
+	}
+	err = json.Unmarshal(data, &account.Registration)
+	if err != nil {
+		return account, nil, fmt.Errorf("Error parsing %s: %s", CERTBOT_REGISTRATION_FILE, err)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dir, CERTBOT_PRIVATE_KEY_FILE))
+	if err != nil {
+		return account, nil, fmt.Errorf("Error reading the account key: %s", err)
+	}
+	jwk := jose.JsonWebKey{}
+	err = json.Unmarshal(data, &jwk)
+	if err != nil {
+		return account, nil, fmt.Errorf("Error parsing the account key %s: %s", CERTBOT_PRIVATE_KEY_FILE, err)
+	}
+	for _, contact := range account.Registration.Body.Contact {
+		if strings.HasPrefix(contact, "mailto:") {
+			account.Email = strings.TrimPrefix(contact, "mailto:")
+			break
+		}
+	}
+	return account, jwk.Key, nil
+}
+
+// completeImportedAccount PEM encodes the key and fills in what the stored
+// registration needs but the other clients may leave out
+func completeImportedAccount(account ImportedAccount, key crypto.PrivateKey) (ImportedAccount, error) {
+	if account.Registration.URI == "" {
+		return account, errors.New("The registration has no URI. Register the account with its client first.")
+	}
+	publicKey, err := accountPublicKey(key)
+	if err != nil {
+		return account, err
+	}
+	pemKey, err := encodeAccountKey(key)
+	if err != nil {
+		return account, err
+	}
+	account.PrivateKey = pemKey
+	if account.Registration.Body.Key.Key == nil {
+		account.Registration.Body.Key = jose.JsonWebKey{Key: publicKey}
+	}
+	if len(account.Registration.Body.Contact) == 0 && account.Email != "" {
+		account.Registration.Body.Contact = []string{"mailto:" + account.Email}
+	}
+	return account, nil
+}
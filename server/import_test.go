@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+func TestReadLegoAccountDirectory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lego")
+	defer os.RemoveAll(dir)
+	accountDir := filepath.Join(dir, "accounts", "acme-v01.api.letsencrypt.org", "ops@example.com")
+	os.MkdirAll(filepath.Join(accountDir, "keys"), 0700)
+	privateKey, _ := generateAccountKey(acme.EC384)
+	ioutil.WriteFile(filepath.Join(accountDir, "keys", "ops@example.com.key"), privateKey, 0600)
+	ioutil.WriteFile(filepath.Join(accountDir, "account.json"), []byte(`{
+	"email": "ops@example.com",
+	"registration": {
+		"body": {"id": 123, "contact": ["mailto:ops@example.com"]},
+		"uri": "https://acme-v01.api.letsencrypt.org/acme/reg/123",
+		"new_authzr_uri": "https://acme-v01.api.letsencrypt.org/acme/new-authz"
+	}
+}`), 0600)
+
+	// The parent directory holds a single account
+	account, err := readAccountDirectory(filepath.Join(dir, "accounts"), "")
+	if err != nil {
+		t.Fatalf("Error reading lego account: %s", err)
+	}
+	if account.Email != "ops@example.com" || account.Registration.URI != "https://acme-v01.api.letsencrypt.org/acme/reg/123" {
+		t.Fatalf("Unexpected account: %#v", account)
+	}
+	if string(account.PrivateKey) != string(privateKey) {
+		t.Fatalf("Expected the lego key")
+	}
+	// The registration has the public key `getUserWithRegistration` needs
+	if _, err := json.Marshal(account.Registration); err != nil {
+		t.Fatalf("Error encoding registration: %s", err)
+	}
+}
+
+func TestReadCertbotAccountDirectory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certbot")
+	defer os.RemoveAll(dir)
+	accountDir := filepath.Join(dir, "acme-v01.api.letsencrypt.org", "directory", "0123456789abcdef")
+	os.MkdirAll(accountDir, 0700)
+	privateKey, _ := generateAccountKey(acme.RSA2048)
+	key, _ := parseAccountKey(privateKey)
+	jwk, _ := json.Marshal(jose.JsonWebKey{Key: key})
+	ioutil.WriteFile(filepath.Join(accountDir, "private_key.json"), jwk, 0600)
+	ioutil.WriteFile(filepath.Join(accountDir, "meta.json"), []byte(`{"creation_host": "example"}`), 0600)
+	ioutil.WriteFile(filepath.Join(accountDir, "regr.json"), []byte(`{
+	"body": {"contact": ["mailto:ops@example.com"], "agreement": "https://letsencrypt.org/terms.pdf", "status": "valid"},
+	"uri": "https://acme-v01.api.letsencrypt.org/acme/reg/456",
+	"new_authzr_uri": "https://acme-v01.api.letsencrypt.org/acme/new-authz",
+	"terms_of_service": "https://letsencrypt.org/terms.pdf"
+}`), 0600)
+
+	account, err := readAccountDirectory(dir, "")
+	if err != nil {
+		t.Fatalf("Error reading certbot account: %s", err)
+	}
+	if account.Email != "ops@example.com" || account.Registration.URI != "https://acme-v01.api.letsencrypt.org/acme/reg/456" || account.Registration.Body.Agreement == "" {
+		t.Fatalf("Unexpected account: %#v", account)
+	}
+	if string(account.PrivateKey) != string(privateKey) {
+		t.Fatalf("Expected the certbot key as PEM:\n%s", account.PrivateKey)
+	}
+	publicKey, ok := account.Registration.Body.Key.Key.(*rsa.PublicKey)
+	if !ok || publicKey.N.Cmp(key.(*rsa.PrivateKey).N) != 0 {
+		t.Fatalf("Expected the public key in the registration: %#v", account.Registration.Body.Key)
+	}
+
+	// Two accounts are ambiguous
+	os.MkdirAll(filepath.Join(dir, "acme-staging.api.letsencrypt.org", "directory", "1"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "acme-staging.api.letsencrypt.org", "directory", "1", "regr.json"), []byte(`{}`), 0600)
+	if _, err := readAccountDirectory(dir, ""); err == nil {
+		t.Fatalf("Expected an error for several accounts")
+	}
+}
+
+func TestImportAccount(t *testing.T) {
+	store := SecretStateStore{AccountSecretName: "lets-encrypt-user"}
+	path := "/api/v1/namespaces/default/secrets/lets-encrypt-user"
+	newAccount := func() ImportedAccount {
+		privateKey, _ := generateAccountKey(acme.EC256)
+		key, _ := parseAccountKey(privateKey)
+		account, err := completeImportedAccount(ImportedAccount{
+			Email:        "ops@example.com",
+			Registration: acme.RegistrationResource{URI: "https://acme.example.com/reg/1"},
+		}, key)
+		if err != nil {
+			t.Fatalf("Error completing account: %s", err)
+		}
+		return account
+	}
+
+	fake := &fakeSecretsServer{secrets: make(map[string]Secret)}
+	withFakeSecretsServer(t, fake, func() {
+		account := newAccount()
+		err := importAccount(store, account, false)
+		if err != nil {
+			t.Fatalf("Error importing account: %s", err)
+		}
+		stored, _ := base64.StdEncoding.DecodeString(fake.secrets[path].Data["private_key"])
+		if string(stored) != string(account.PrivateKey) {
+			t.Fatalf("Account key was not stored")
+		}
+		registration, err := store.LoadRegistration()
+		if err != nil || registration == nil || registration.URI != "https://acme.example.com/reg/1" {
+			t.Fatalf("Registration was not stored: %v %s", registration, err)
+		}
+		// Importing the same account again is fine
+		err = importAccount(store, account, false)
+		if err != nil {
+			t.Fatalf("Error importing the account again: %s", err)
+		}
+
+		// A different account is only imported with force
+		other := newAccount()
+		if err := importAccount(store, other, false); err == nil {
+			t.Fatalf("Expected the stored key not to be replaced")
+		}
+		err = importAccount(store, other, true)
+		if err != nil {
+			t.Fatalf("Error replacing account: %s", err)
+		}
+		stored, _ = base64.StdEncoding.DecodeString(fake.secrets[path].Data["private_key"])
+		if string(stored) != string(other.PrivateKey) {
+			t.Fatalf("Account key was not replaced")
+		}
+	})
+}
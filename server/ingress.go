@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Ingresses are only managed when they have this annotation set to "true"
+var INGRESS_ANNOTATION = "auto-kubernetes-lets-encrypt/enabled"
+
+// Optional key type of the certificates of an Ingress (`rsa2048`, `ec256`, ...)
+var INGRESS_KEY_TYPE_ANNOTATION = "auto-kubernetes-lets-encrypt/key-type"
+
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Generation      int64             `json:"generation,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
+}
+
+type OwnerReference struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	Controller bool   `json:"controller,omitempty"`
+}
+
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type Ingress struct {
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     IngressSpec `json:"spec"`
+}
+
+type IngressSpec struct {
+	TLS []IngressTLS `json:"tls,omitempty"`
+}
+
+type IngressTLS struct {
+	Hosts      []string `json:"hosts,omitempty"`
+	SecretName string   `json:"secretName,omitempty"`
+}
+
+type IngressList struct {
+	Metadata ListMeta  `json:"metadata"`
+	Items    []Ingress `json:"items"`
+}
+
+type IngressWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// IngressController keeps track of the certificates requested by Ingresses
+// and issues or renews them
+type IngressController struct {
+	sync.Mutex
+	email string
+	// Certificates managed for each Ingress, keyed by `namespace/name`
+	ingresses map[string][]CertificateTarget
+	changed   chan bool
+}
+
+func NewIngressController(email string) *IngressController {
+	return &IngressController{
+		email:     email,
+		ingresses: make(map[string][]CertificateTarget),
+		changed:   make(chan bool, 1),
+	}
+}
+
+func runIngressController(email string) error {
+	err := loadRenewalSettings()
+	if err != nil {
+		return err
+	}
+	ingressesPath, err := ingressesPath()
+	if err != nil {
+		return err
+	}
+
+	controller := NewIngressController(email)
+	go controller.watch(ingressesPath)
+	log.Printf("Starting ingress controller (Annotation: %s, Renew before: %s, Check interval: %s)", INGRESS_ANNOTATION, RENEW_BEFORE, RENEW_CHECK_INTERVAL)
+	for {
+		select {
+		case <-controller.changed:
+			log.Printf("Ingresses changed. Reconciling certificates")
+		case <-time.After(RENEW_CHECK_INTERVAL):
+			log.Printf("Checking certificates for renewal")
+		}
+		controller.reconcile()
+	}
+}
+
+// ingressesPath returns the API path for the Ingresses watched by the
+// controller. `WATCH_NAMESPACE` defaults to the namespace of the pod, `*`
+// watches all namespaces.
+func ingressesPath() (string, error) {
+	apiVersion := Getenv("INGRESS_API_VERSION", "extensions/v1beta1")
+	namespace := Getenv("WATCH_NAMESPACE", "")
+	if namespace == "*" {
+		return fmt.Sprintf("/apis/%s/ingresses", apiVersion), nil
+	}
+	if namespace == "" {
+		podNamespace, err := getNamespace()
+		if err != nil {
+			return "", err
+		}
+		namespace = podNamespace
+	}
+	return fmt.Sprintf("/apis/%s/namespaces/%s/ingresses", apiVersion, namespace), nil
+}
+
+// watch lists all Ingresses and then watches them for changes. If the watch
+// is closed or expires the Ingresses are listed again.
+func (c *IngressController) watch(path string) {
+	for {
+		resourceVersion, err := c.list(path)
+		if err != nil {
+			log.Printf("Error listing ingresses: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		err = c.watchFrom(path, resourceVersion)
+		if err != nil {
+			log.Printf("Error watching ingresses: %s", err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func (c *IngressController) list(path string) (string, error) {
+	statusCode, body, err := kubernetesRequest("GET", path, "", nil)
+	if err != nil {
+		return "", err
+	}
+	if statusCode != 200 {
+		return "", fmt.Errorf("Listing ingresses did not return 200 (Status Code: %d): %s", statusCode, string(body))
+	}
+	list := IngressList{}
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return "", err
+	}
+	c.Lock()
+	c.ingresses = make(map[string][]CertificateTarget)
+	for _, ingress := range list.Items {
+		c.setIngress(ingress)
+	}
+	c.Unlock()
+	c.notify()
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (c *IngressController) watchFrom(path string, resourceVersion string) error {
+	log.Printf("Watching ingresses from resource version %s", resourceVersion)
+	stream, err := kubernetesStream(fmt.Sprintf("%s?watch=true&resourceVersion=%s", path, resourceVersion))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	decoder := json.NewDecoder(stream)
+	for {
+		event := IngressWatchEvent{}
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			log.Printf("Ingress watch closed")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			// Usually `410 Gone` once the resource version is too old
+			return fmt.Errorf("Ingress watch returned an error: %s", string(event.Object))
+		}
+		ingress := Ingress{}
+		err = json.Unmarshal(event.Object, &ingress)
+		if err != nil {
+			return err
+		}
+		log.Printf("Ingress %s/%s %s", ingress.Metadata.Namespace, ingress.Metadata.Name, strings.ToLower(event.Type))
+		c.Lock()
+		if event.Type == "DELETED" {
+			c.removeIngress(ingress)
+		} else {
+			c.setIngress(ingress)
+		}
+		c.Unlock()
+		c.notify()
+	}
+}
+
+// setIngress updates the certificates managed for an Ingress. Certificates
+// for TLS entries that were removed (or for Ingresses that lost the
+// annotation) are no longer managed.
+func (c *IngressController) setIngress(ingress Ingress) {
+	key := ingress.Metadata.Namespace + "/" + ingress.Metadata.Name
+	targets := ingressCertificateTargets(ingress)
+	for _, previous := range c.ingresses[key] {
+		if !containsTarget(targets, previous) {
+			log.Printf("Stopped managing secret %s/%s for ingress %s", previous.Namespace, previous.SecretName, key)
+		}
+	}
+	if len(targets) == 0 {
+		delete(c.ingresses, key)
+		return
+	}
+	c.ingresses[key] = targets
+}
+
+func (c *IngressController) removeIngress(ingress Ingress) {
+	c.setIngress(Ingress{Metadata: ingress.Metadata})
+}
+
+func (c *IngressController) notify() {
+	select {
+	case c.changed <- true:
+	default:
+	}
+}
+
+// reconcile ensures every managed secret holds a valid certificate
+func (c *IngressController) reconcile() {
+	c.Lock()
+	targets := []CertificateTarget{}
+	ingressKeys := []string{}
+	for key := range c.ingresses {
+		ingressKeys = append(ingressKeys, key)
+	}
+	sort.Strings(ingressKeys)
+	for _, key := range ingressKeys {
+		targets = append(targets, c.ingresses[key]...)
+	}
+	c.Unlock()
+
+	for _, target := range targets {
+		log.Printf("Ensuring certificate for %s in secret %s/%s", target.Domains, target.Namespace, target.SecretName)
+		_, err := issueWithFailover(target, c.email, ensureCertificate)
+		if err != nil {
+			log.Printf("Error ensuring certificate for %s: %s", target.Domains, err)
+		}
+	}
+}
+
+func ingressCertificateTargets(ingress Ingress) []CertificateTarget {
+	targets := []CertificateTarget{}
+	if ingress.Metadata.Annotations[INGRESS_ANNOTATION] != "true" {
+		return targets
+	}
+	var keyType acme.KeyType
+	if name := ingress.Metadata.Annotations[INGRESS_KEY_TYPE_ANNOTATION]; name != "" {
+		var err error
+		keyType, err = parseCertificateKeyType(name)
+		if err != nil {
+			log.Printf("Ignoring ingress %s/%s: %s", ingress.Metadata.Namespace, ingress.Metadata.Name, err)
+			return targets
+		}
+	}
+	for _, tls := range ingress.Spec.TLS {
+		if tls.SecretName == "" || len(tls.Hosts) == 0 {
+			continue
+		}
+		targets = append(targets, CertificateTarget{
+			Namespace:  ingress.Metadata.Namespace,
+			SecretName: tls.SecretName,
+			Domains:    tls.Hosts,
+			KeyType:    keyType,
+			// Ingress controllers only read `kubernetes.io/tls` secrets
+			Layout: SECRET_LAYOUT_TLS,
+		})
+	}
+	return targets
+}
+
+func containsTarget(targets []CertificateTarget, target CertificateTarget) bool {
+	for _, t := range targets {
+		if t.Namespace == target.Namespace && t.SecretName == target.SecretName && strings.Join(t.Domains, ",") == strings.Join(target.Domains, ",") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func newIngress(name string, annotations map[string]string, tls ...IngressTLS) Ingress {
+	return Ingress{
+		Metadata: ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+		Spec:     IngressSpec{TLS: tls},
+	}
+}
+
+var ingressEnabled = map[string]string{INGRESS_ANNOTATION: "true"}
+
+func TestIngressCertificateTargets(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		ingress Ingress
+		// Secret names and domains of the expected targets
+		targets []string
+		keyType acme.KeyType
+	}{
+		{
+			name:    "annotation missing",
+			ingress: newIngress("web", nil, IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"}),
+			targets: []string{},
+		},
+		{
+			name:    "annotation off",
+			ingress: newIngress("web", map[string]string{INGRESS_ANNOTATION: "false"}, IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"}),
+			targets: []string{},
+		},
+		{
+			name:    "annotation on",
+			ingress: newIngress("web", ingressEnabled, IngressTLS{Hosts: []string{"example.com", "www.example.com"}, SecretName: "example-tls"}),
+			targets: []string{"example-tls=example.com,www.example.com"},
+		},
+		{
+			name: "several TLS entries",
+			ingress: newIngress("web", ingressEnabled,
+				IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"},
+				IngressTLS{Hosts: []string{"api.example.com"}, SecretName: "api-tls"},
+			),
+			targets: []string{"example-tls=example.com", "api-tls=api.example.com"},
+		},
+		{
+			name: "TLS entries without hosts or secret",
+			ingress: newIngress("web", ingressEnabled,
+				IngressTLS{SecretName: "no-hosts-tls"},
+				IngressTLS{Hosts: []string{"example.com"}},
+				IngressTLS{Hosts: []string{"api.example.com"}, SecretName: "api-tls"},
+			),
+			targets: []string{"api-tls=api.example.com"},
+		},
+		{
+			name:    "key type",
+			ingress: newIngress("web", map[string]string{INGRESS_ANNOTATION: "true", INGRESS_KEY_TYPE_ANNOTATION: "ec256"}, IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"}),
+			targets: []string{"example-tls=example.com"},
+			keyType: acme.EC256,
+		},
+		{
+			name:    "invalid key type",
+			ingress: newIngress("web", map[string]string{INGRESS_ANNOTATION: "true", INGRESS_KEY_TYPE_ANNOTATION: "dsa1024"}, IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"}),
+			targets: []string{},
+		},
+	} {
+		targets := ingressCertificateTargets(test.ingress)
+		names := []string{}
+		for _, target := range targets {
+			names = append(names, target.SecretName+"="+strings.Join(target.Domains, ","))
+			if target.Namespace != "default" || target.Layout != SECRET_LAYOUT_TLS || target.KeyType != test.keyType {
+				t.Errorf("%s: Unexpected target: %#v", test.name, target)
+			}
+		}
+		if strings.Join(names, ";") != strings.Join(test.targets, ";") {
+			t.Errorf("%s: Expected targets %v: %v", test.name, test.targets, names)
+		}
+	}
+}
+
+// managedSecrets returns the secret names managed for each Ingress
+func managedSecrets(c *IngressController) map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	secrets := make(map[string]string)
+	for key, targets := range c.ingresses {
+		names := []string{}
+		for _, target := range targets {
+			names = append(names, target.SecretName)
+		}
+		secrets[key] = strings.Join(names, ",")
+	}
+	return secrets
+}
+
+func TestIngressControllerSetIngress(t *testing.T) {
+	c := NewIngressController("ops@example.com")
+	web := newIngress("web", ingressEnabled,
+		IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"},
+		IngressTLS{Hosts: []string{"api.example.com"}, SecretName: "api-tls"},
+	)
+	other := newIngress("other", ingressEnabled, IngressTLS{Hosts: []string{"example.org"}, SecretName: "other-tls"})
+	c.setIngress(web)
+	c.setIngress(other)
+	if secrets := managedSecrets(c); len(secrets) != 2 || secrets["default/web"] != "example-tls,api-tls" || secrets["default/other"] != "other-tls" {
+		t.Fatalf("Unexpected managed secrets: %v", secrets)
+	}
+
+	// TLS entry removed
+	web.Spec.TLS = web.Spec.TLS[:1]
+	c.setIngress(web)
+	if secrets := managedSecrets(c); secrets["default/web"] != "example-tls" {
+		t.Fatalf("Expected the removed TLS entry not to be managed: %v", secrets)
+	}
+
+	// Annotation removed
+	web.Metadata.Annotations = nil
+	c.setIngress(web)
+	if secrets := managedSecrets(c); len(secrets) != 1 || secrets["default/other"] != "other-tls" {
+		t.Fatalf("Expected the Ingress without annotation not to be managed: %v", secrets)
+	}
+
+	// Ingress deleted
+	c.removeIngress(other)
+	if secrets := managedSecrets(c); len(secrets) != 0 {
+		t.Fatalf("Expected the deleted Ingress not to be managed: %v", secrets)
+	}
+}
+
+// fakeIngressServer serves a list of Ingresses for each list request and a
+// stream of watch events for each resource version
+type fakeIngressServer struct {
+	sync.Mutex
+	lists    []IngressList
+	events   map[string][]IngressWatchEvent
+	requests []string
+}
+
+func (f *fakeIngressServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	if r.URL.Path != "/apis/extensions/v1beta1/namespaces/default/ingresses" {
+		w.WriteHeader(404)
+		return
+	}
+	if r.URL.Query().Get("watch") != "true" {
+		list := f.lists[0]
+		f.lists = f.lists[1:]
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	for _, event := range f.events[r.URL.Query().Get("resourceVersion")] {
+		encoder.Encode(event)
+	}
+}
+
+func ingressEvent(t *testing.T, eventType string, object interface{}) IngressWatchEvent {
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("Error marshaling %s event: %s", eventType, err)
+	}
+	return IngressWatchEvent{Type: eventType, Object: data}
+}
+
+func TestIngressControllerWatch(t *testing.T) {
+	web := newIngress("web", ingressEnabled, IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"})
+	api := newIngress("api", ingressEnabled, IngressTLS{Hosts: []string{"api.example.com"}, SecretName: "api-tls"})
+	disabled := newIngress("web", nil, IngressTLS{Hosts: []string{"example.com"}, SecretName: "example-tls"})
+	other := newIngress("other", ingressEnabled, IngressTLS{Hosts: []string{"example.org"}, SecretName: "other-tls"})
+	fake := &fakeIngressServer{
+		lists: []IngressList{
+			{Metadata: ListMeta{ResourceVersion: "10"}, Items: []Ingress{web}},
+			// Listed again after the watch expired
+			{Metadata: ListMeta{ResourceVersion: "20"}, Items: []Ingress{other}},
+		},
+		events: map[string][]IngressWatchEvent{
+			"10": {
+				ingressEvent(t, "ADDED", api),
+				ingressEvent(t, "MODIFIED", disabled),
+				ingressEvent(t, "DELETED", api),
+				ingressEvent(t, "ADDED", other),
+				ingressEvent(t, "ERROR", map[string]interface{}{"kind": "Status", "code": 410, "reason": "Gone"}),
+			},
+		},
+	}
+	path := "/apis/extensions/v1beta1/namespaces/default/ingresses"
+	c := NewIngressController("ops@example.com")
+	withFakeKubernetesServer(t, fake, func() {
+		resourceVersion, err := c.list(path)
+		if err != nil || resourceVersion != "10" {
+			t.Fatalf("Error listing ingresses: %s %v", resourceVersion, err)
+		}
+		if secrets := managedSecrets(c); len(secrets) != 1 || secrets["default/web"] != "example-tls" {
+			t.Fatalf("Unexpected managed secrets after listing: %v", secrets)
+		}
+		<-c.changed
+
+		err = c.watchFrom(path, resourceVersion)
+		if err == nil || !strings.Contains(err.Error(), "410") {
+			t.Fatalf("Expected the watch to end with 410 Gone: %v", err)
+		}
+		if secrets := managedSecrets(c); len(secrets) != 1 || secrets["default/other"] != "other-tls" {
+			t.Fatalf("Unexpected managed secrets after the watch events: %v", secrets)
+		}
+		<-c.changed
+
+		// The Ingresses are listed again, replacing the ones managed so far
+		c.setIngress(api)
+		resourceVersion, err = c.list(path)
+		if err != nil || resourceVersion != "20" {
+			t.Fatalf("Error listing ingresses again: %s %v", resourceVersion, err)
+		}
+		if secrets := managedSecrets(c); len(secrets) != 1 || secrets["default/other"] != "other-tls" {
+			t.Fatalf("Unexpected managed secrets after listing again: %v", secrets)
+		}
+		err = c.watchFrom(path, resourceVersion)
+		if err != nil {
+			t.Fatalf("Expected the watch to be closed: %s", err)
+		}
+	})
+	if len(fake.requests) != 4 || fake.requests[1] != path+"?watch=true&resourceVersion=10" || fake.requests[3] != path+"?watch=true&resourceVersion=20" {
+		t.Fatalf("Unexpected requests: %v", fake.requests)
+	}
+}
@@ -126,7 +126,7 @@ func TestCreatingJob(t *testing.T) {
 	err, dstFilaname := copyFileContentsAndReplace("./test-fixtures/", "kubernetes-resources.yml", testId, imageName)
 	if err != nil {
 		failed = true
-		t.Fatalf("Failed to execute file replacement", err.Error())
+		t.Fatalf("Failed to execute file replacement: %s", err.Error())
 	}
 	fullCommand := fmt.Sprintf("kubectl --namespace %s apply -f %s", testId, dstFilaname)
 	t.Logf("Update kubernetes with command: `%s`", fullCommand)
@@ -163,7 +163,7 @@ func TestCreatingOfIp(t *testing.T) {
 			continue
 		}
 		serviceIPaddress = res.Status.LoadBalancer.Ingress[0].Ip
-		t.Log("IP address found: %s", serviceIPaddress)
+		t.Logf("IP address found: %s", serviceIPaddress)
 		break
 	}
 }
@@ -189,13 +189,13 @@ func TestCreatingOfDNSEntry(t *testing.T) {
 	}
 	if resp.StatusCode != 200 {
 		failed = true
-		t.Fatalf("Error creating DNS entry (Status code is not 200): %s", resp.StatusCode)
+		t.Fatalf("Error creating DNS entry (Status code is not 200): %d", resp.StatusCode)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		failed = true
-		t.Fatalf("Error creating DNS entry: %s, %s", resp.StatusCode, err)
+		t.Fatalf("Error creating DNS entry: %d, %s", resp.StatusCode, err)
 	}
 	res := CloudflareZoneCreationResponse{}
 	err = json.Unmarshal([]byte(body), &res)
@@ -205,7 +205,7 @@ func TestCreatingOfDNSEntry(t *testing.T) {
 	}
 	if res.Result.Id == "" {
 		failed = true
-		t.Fatalf("Error getting ID for result: %s", res)
+		t.Fatalf("Error getting ID for result: %v", res)
 	}
 	dnsRecordId = res.Result.Id
 }
@@ -220,11 +220,11 @@ func TestDNSResolution(t *testing.T) {
 		time.Sleep(1000 * time.Millisecond)
 		ips, err := net.LookupIP(url)
 		if err != nil {
-			t.Log("Error looking up IP for DNS entry: %s", err)
+			t.Logf("Error looking up IP for DNS entry: %s", err)
 			continue
 		}
 		if ips[0].String() != serviceIPaddress {
-			t.Log("Error looking up IP for DNS entry: %s", err)
+			t.Logf("Error looking up IP for DNS entry: %s", err)
 			continue
 		}
 		break
@@ -243,7 +243,7 @@ func TestHealth(t *testing.T) {
 		time.Sleep(1000 * time.Millisecond)
 		resp, err := http.Get(url)
 		if err != nil || resp.StatusCode != 200 {
-			t.Log("Error making HTTP response: %s", err)
+			t.Logf("Error making HTTP response: %s", err)
 			continue
 		}
 		defer resp.Body.Close()
@@ -307,7 +307,7 @@ func TestRegistrationCreation(t *testing.T) {
 	}
 	if res.Data["registration"] == "" {
 		failed = true
-		t.Fatalf("Registration not found: %s", res.Data, output)
+		t.Fatalf("Registration not found: %s (%s)", res.Data, output)
 		return
 	}
 }
@@ -347,7 +347,7 @@ func DeleteNamespace() error {
 	log.Printf("Delete namespace with command: %s", fullCommand)
 	err, output := execCommand(fullCommand)
 	if err != nil {
-		log.Fatal("Error deleting namespace: %s", output)
+		log.Fatalf("Error deleting namespace: %s", output)
 		return err
 	}
 	return nil
@@ -381,11 +381,11 @@ func DeleteDNSEntry() error {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("Error deleting DNS entry: %s, %s", resp.StatusCode, err)
+		log.Fatalf("Error deleting DNS entry: %s", err)
 		return err
 	}
 	defer resp.Body.Close()
-	log.Printf("Status code: %s", resp.StatusCode)
+	log.Printf("Status code: %d", resp.StatusCode)
 	return nil
 }
 
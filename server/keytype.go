@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Key types the private key of a certificate can be generated with
+// (`spec.keyType`, the key type annotation of Ingresses or `KEY_TYPE`)
+var certificateKeyTypes = map[string]acme.KeyType{
+	"rsa2048": acme.RSA2048,
+	"rsa4096": acme.RSA4096,
+	"rsa8192": acme.RSA8192,
+	"ec256":   acme.EC256,
+	"ec384":   acme.EC384,
+}
+
+func parseCertificateKeyType(name string) (acme.KeyType, error) {
+	keyType, ok := certificateKeyTypes[name]
+	if !ok {
+		return "", configError("Unknown key type %s (Expected `rsa2048`, `rsa4096`, `rsa8192`, `ec256` or `ec384`)", name)
+	}
+	return keyType, nil
+}
+
+// certificateKeyType returns the key type of the target, falling back to
+// `KEY_TYPE`. It returns an empty key type if neither is set.
+func certificateKeyType(target CertificateTarget) (acme.KeyType, error) {
+	if target.KeyType != "" {
+		return target.KeyType, nil
+	}
+	name := Getenv("KEY_TYPE", "")
+	if name == "" {
+		return "", nil
+	}
+	return parseCertificateKeyType(name)
+}
+
+// generateCertificateKey generates the private key of a certificate. The lego
+// client generates its own, this is for the ACME v2 client.
+func generateCertificateKey(keyType acme.KeyType) (crypto.PrivateKey, error) {
+	switch keyType {
+	case acme.RSA2048, "":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case acme.RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case acme.RSA8192:
+		return rsa.GenerateKey(rand.Reader, 8192)
+	case acme.EC256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case acme.EC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", keyType)
+}
+
+// privateKeyType returns the key type of a PEM encoded private key, either
+// PKCS#1, SEC1 or PKCS#8
+func privateKeyType(pemKey []byte) (acme.KeyType, error) {
+	key, err := parseAccountKey(pemKey)
+	if err != nil {
+		return "", err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return rsaKeyType(key)
+	case *ecdsa.PrivateKey:
+		return ecKeyType(key)
+	}
+	return "", fmt.Errorf("Unsupported private key of type %T", key)
+}
+
+func rsaKeyType(key *rsa.PrivateKey) (acme.KeyType, error) {
+	switch key.N.BitLen() {
+	case 2048:
+		return acme.RSA2048, nil
+	case 4096:
+		return acme.RSA4096, nil
+	case 8192:
+		return acme.RSA8192, nil
+	}
+	return "", fmt.Errorf("Unsupported RSA key size %d", key.N.BitLen())
+}
+
+func ecKeyType(key *ecdsa.PrivateKey) (acme.KeyType, error) {
+	switch key.Curve.Params().Name {
+	case "P-256":
+		return acme.EC256, nil
+	case "P-384":
+		return acme.EC384, nil
+	}
+	return "", fmt.Errorf("Unsupported curve %s", key.Curve.Params().Name)
+}
+
+// reusableKey returns the key type a renewal of the certificate is requested
+// with and the certificate to pass to the renewal. The private key of the
+// certificate is only reused if it's of the key type of the target, otherwise
+// it's dropped so a new key of that type is generated. Without a key type the
+// existing key is kept as it is.
+func reusableKey(target CertificateTarget, certificates acme.CertificateResource) (acme.KeyType, acme.CertificateResource, error) {
+	keyType, err := certificateKeyType(target)
+	if err != nil {
+		return keyType, certificates, err
+	}
+	if len(certificates.PrivateKey) == 0 {
+		if keyType == "" {
+			keyType = acme.RSA2048
+		}
+		return keyType, certificates, nil
+	}
+	existingKeyType, err := privateKeyType(certificates.PrivateKey)
+	if err != nil {
+		log.Printf("Not reusing the private key of %s: %s", target.Domains, err)
+		certificates.PrivateKey = nil
+		if keyType == "" {
+			keyType = acme.RSA2048
+		}
+		return keyType, certificates, nil
+	}
+	if keyType == "" {
+		return existingKeyType, certificates, nil
+	}
+	if existingKeyType != keyType {
+		log.Printf("Private key of %s is %s but %s is configured. Generating a new %s key.", target.Domains, existingKeyType, keyType, keyType)
+		certificates.PrivateKey = nil
+	}
+	return keyType, certificates, nil
+}
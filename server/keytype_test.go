@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestPrivateKeyType(t *testing.T) {
+	for _, keyType := range []acme.KeyType{acme.RSA2048, acme.EC256, acme.EC384} {
+		privateKey, err := generateAccountKey(keyType)
+		if err != nil {
+			t.Fatalf("Error generating %s key: %s", keyType, err)
+		}
+		detected, err := privateKeyType(privateKey)
+		if err != nil || detected != keyType {
+			t.Fatalf("Expected %s, got %s (%v)", keyType, detected, err)
+		}
+	}
+	// PKCS#8, as written by `openssl genpkey`
+	if detected, err := privateKeyType([]byte(testPKCS8ECKey)); err != nil || detected != acme.EC256 {
+		t.Fatalf("Expected PKCS#8 %s, got %s (%v)", acme.EC256, detected, err)
+	}
+	if _, err := privateKeyType([]byte(testPKCS8RSAKey)); err == nil || !strings.Contains(err.Error(), "1024") {
+		t.Fatalf("Expected an error for a 1024 bit PKCS#8 RSA key: %v", err)
+	}
+	if _, err := privateKeyType([]byte("not a key")); err == nil {
+		t.Fatalf("Expected an error for an invalid key")
+	}
+}
+
+func TestReusableKey(t *testing.T) {
+	defer os.Setenv("KEY_TYPE", os.Getenv("KEY_TYPE"))
+	os.Setenv("KEY_TYPE", "")
+	rsaKey, _ := generateAccountKey(acme.RSA2048)
+	certificates := acme.CertificateResource{Domain: "example.com", PrivateKey: rsaKey}
+
+	// Without a key type the existing key is reused, whatever its type
+	keyType, renewal, err := reusableKey(CertificateTarget{}, certificates)
+	if err != nil || keyType != acme.RSA2048 || string(renewal.PrivateKey) != string(rsaKey) {
+		t.Fatalf("Expected the RSA key to be reused: %s %v", keyType, err)
+	}
+
+	// PKCS#8 keys are reused too
+	pkcs8Certificates := acme.CertificateResource{Domain: "example.com", PrivateKey: []byte(testPKCS8ECKey)}
+	keyType, renewal, err = reusableKey(CertificateTarget{KeyType: acme.EC256}, pkcs8Certificates)
+	if err != nil || keyType != acme.EC256 || string(renewal.PrivateKey) != testPKCS8ECKey {
+		t.Fatalf("Expected the PKCS#8 EC key to be reused: %s %v", keyType, err)
+	}
+
+	// A different key type replaces the key
+	keyType, renewal, err = reusableKey(CertificateTarget{KeyType: acme.EC256}, certificates)
+	if err != nil || keyType != acme.EC256 || renewal.PrivateKey != nil {
+		t.Fatalf("Expected a new EC256 key: %s %v", keyType, err)
+	}
+
+	// `KEY_TYPE` applies to targets without a key type
+	os.Setenv("KEY_TYPE", "ec384")
+	keyType, renewal, err = reusableKey(CertificateTarget{}, certificates)
+	if err != nil || keyType != acme.EC384 || renewal.PrivateKey != nil {
+		t.Fatalf("Expected a new EC384 key: %s %v", keyType, err)
+	}
+	os.Setenv("KEY_TYPE", "dsa")
+	if _, _, err = reusableKey(CertificateTarget{}, certificates); err == nil {
+		t.Fatalf("Expected an error for an unknown key type")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Kubeconfig is the subset of a kubeconfig file (`~/.kube/config`) needed to
+// connect to the API server
+type Kubeconfig struct {
+	CurrentContext string              `yaml:"current-context"`
+	Clusters       []KubeconfigCluster `yaml:"clusters"`
+	Contexts       []KubeconfigContext `yaml:"contexts"`
+	Users          []KubeconfigUser    `yaml:"users"`
+}
+
+type KubeconfigCluster struct {
+	Name    string `yaml:"name"`
+	Cluster struct {
+		Server                   string `yaml:"server"`
+		CertificateAuthority     string `yaml:"certificate-authority"`
+		CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	} `yaml:"cluster"`
+}
+
+type KubeconfigContext struct {
+	Name    string `yaml:"name"`
+	Context struct {
+		Cluster   string `yaml:"cluster"`
+		User      string `yaml:"user"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"context"`
+}
+
+type KubeconfigUser struct {
+	Name string `yaml:"name"`
+	User struct {
+		ClientCertificate     string `yaml:"client-certificate"`
+		ClientCertificateData string `yaml:"client-certificate-data"`
+		ClientKey             string `yaml:"client-key"`
+		ClientKeyData         string `yaml:"client-key-data"`
+		Token                 string `yaml:"token"`
+		TokenFile             string `yaml:"tokenFile"`
+		Username              string `yaml:"username"`
+		Password              string `yaml:"password"`
+	} `yaml:"user"`
+}
+
+// kubeconfigPaths returns the kubeconfigs to use: `--kubeconfig`, the files
+// in `KUBECONFIG` or `~/.kube/config`
+func kubeconfigPaths() []string {
+	if KUBECONFIG_PATH != "" {
+		return []string{KUBECONFIG_PATH}
+	}
+	paths := []string{}
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		paths = append(paths, filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+	}
+	return paths
+}
+
+// readKubeconfig parses a kubeconfig. Relative paths of the files it refers
+// to are made relative to the kubeconfig.
+func readKubeconfig(path string) (Kubeconfig, error) {
+	kubeconfig := Kubeconfig{}
+	fileData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return kubeconfig, err
+	}
+	err = yaml.Unmarshal(fileData, &kubeconfig)
+	if err != nil {
+		return kubeconfig, fmt.Errorf("Error parsing kubeconfig %s: %s", path, err)
+	}
+	dir := filepath.Dir(path)
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(dir, file)
+	}
+	for i := range kubeconfig.Clusters {
+		cluster := &kubeconfig.Clusters[i].Cluster
+		cluster.CertificateAuthority = resolve(cluster.CertificateAuthority)
+	}
+	for i := range kubeconfig.Users {
+		user := &kubeconfig.Users[i].User
+		user.ClientCertificate = resolve(user.ClientCertificate)
+		user.ClientKey = resolve(user.ClientKey)
+		user.TokenFile = resolve(user.TokenFile)
+	}
+	return kubeconfig, nil
+}
+
+// mergeKubeconfigs merges the kubeconfigs like kubectl does: the first
+// `current-context` and the first cluster, context and user of each name win
+func mergeKubeconfigs(kubeconfigs []Kubeconfig) Kubeconfig {
+	merged := Kubeconfig{}
+	clusters := map[string]bool{}
+	contexts := map[string]bool{}
+	users := map[string]bool{}
+	for _, kubeconfig := range kubeconfigs {
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = kubeconfig.CurrentContext
+		}
+		for _, cluster := range kubeconfig.Clusters {
+			if !clusters[cluster.Name] {
+				clusters[cluster.Name] = true
+				merged.Clusters = append(merged.Clusters, cluster)
+			}
+		}
+		for _, context := range kubeconfig.Contexts {
+			if !contexts[context.Name] {
+				contexts[context.Name] = true
+				merged.Contexts = append(merged.Contexts, context)
+			}
+		}
+		for _, user := range kubeconfig.Users {
+			if !users[user.Name] {
+				users[user.Name] = true
+				merged.Users = append(merged.Users, user)
+			}
+		}
+	}
+	return merged
+}
+
+// loadKubeconfig reads the connection settings of a context in the
+// kubeconfigs, merged like kubectl does. Like kubectl, files in `KUBECONFIG`
+// that don't exist are skipped. An empty context uses the `current-context`.
+func loadKubeconfig(paths []string, contextName string) (*KubernetesConfig, error) {
+	kubeconfigs := []Kubeconfig{}
+	for _, path := range paths {
+		log.Printf("Loading kubeconfig from %s", path)
+		kubeconfig, err := readKubeconfig(path)
+		if os.IsNotExist(err) && len(paths) > 1 {
+			log.Printf("Skipping missing kubeconfig %s", path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kubeconfigs = append(kubeconfigs, kubeconfig)
+	}
+	source := strings.Join(paths, string(filepath.ListSeparator))
+	if len(kubeconfigs) == 0 {
+		return nil, fmt.Errorf("None of the kubeconfigs %s exist", source)
+	}
+	kubeconfig := mergeKubeconfigs(kubeconfigs)
+	if contextName == "" {
+		contextName = kubeconfig.CurrentContext
+	}
+	if contextName == "" {
+		return nil, fmt.Errorf("No context selected and no `current-context` in %s", source)
+	}
+
+	var context *KubeconfigContext
+	for i := range kubeconfig.Contexts {
+		if kubeconfig.Contexts[i].Name == contextName {
+			context = &kubeconfig.Contexts[i]
+		}
+	}
+	if context == nil {
+		return nil, fmt.Errorf("Context `%s` not found in %s", contextName, source)
+	}
+	var cluster *KubeconfigCluster
+	for i := range kubeconfig.Clusters {
+		if kubeconfig.Clusters[i].Name == context.Context.Cluster {
+			cluster = &kubeconfig.Clusters[i]
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("Cluster `%s` of context `%s` not found in %s", context.Context.Cluster, contextName, source)
+	}
+	var user *KubeconfigUser
+	for i := range kubeconfig.Users {
+		if kubeconfig.Users[i].Name == context.Context.User {
+			user = &kubeconfig.Users[i]
+		}
+	}
+
+	config := &KubernetesConfig{
+		Host:                  strings.TrimSuffix(cluster.Cluster.Server, "/"),
+		Namespace:             context.Context.Namespace,
+		InsecureSkipTLSVerify: cluster.Cluster.InsecureSkipTLSVerify,
+	}
+	if config.Namespace == "" {
+		config.Namespace = "default"
+	}
+	var err error
+	config.CAData, err = kubeconfigData(cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the CA of cluster `%s`: %s", cluster.Name, err)
+	}
+	if user == nil {
+		return config, nil
+	}
+
+	config.Token = user.User.Token
+	config.TokenFile = user.User.TokenFile
+	config.Username = user.User.Username
+	config.Password = user.User.Password
+	certData, err := kubeconfigData(user.User.ClientCertificateData, user.User.ClientCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the client certificate of user `%s`: %s", user.Name, err)
+	}
+	keyData, err := kubeconfigData(user.User.ClientKeyData, user.User.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the client key of user `%s`: %s", user.Name, err)
+	}
+	if len(certData) > 0 {
+		certificate, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading the client certificate of user `%s`: %s", user.Name, err)
+		}
+		config.ClientCertificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// kubeconfigData returns the base64 encoded data or else the contents of the
+// file it refers to
+func kubeconfigData(data string, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
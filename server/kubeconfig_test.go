@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: laptop
+clusters:
+- name: production
+  cluster:
+    server: https://production.example.com:6443/
+    certificate-authority-data: CA_DATA
+- name: minikube
+  cluster:
+    server: https://192.168.99.100:8443
+    certificate-authority: ca.crt
+contexts:
+- name: laptop
+  context:
+    cluster: minikube
+    user: minikube
+- name: ci
+  context:
+    cluster: production
+    user: ci
+    namespace: certs
+users:
+- name: minikube
+  user:
+    client-certificate: client.crt
+    client-key: client.key
+- name: ci
+  user:
+    token: ci-token
+`
+
+// writeTestKubeconfig writes the kubeconfig and the files it refers to into a
+// temporary directory and returns its path and CA
+func writeTestKubeconfig(t *testing.T) (string, []byte) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	ca, _ := selfSignedCertificate(t, nil, time.Now().Add(time.Hour))
+	clientCert, clientKey := selfSignedCertificate(t, nil, time.Now().Add(time.Hour))
+	ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "client.crt"), clientCert, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "client.key"), clientKey, 0600)
+	kubeconfig := strings.Replace(testKubeconfig, "CA_DATA", base64.StdEncoding.EncodeToString(ca), 1)
+	path := filepath.Join(dir, "config")
+	ioutil.WriteFile(path, []byte(kubeconfig), 0600)
+	return path, ca
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	path, ca := writeTestKubeconfig(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// The current context with files relative to the kubeconfig
+	config, err := loadKubeconfig([]string{path}, "")
+	if err != nil {
+		t.Fatalf("Error loading kubeconfig: %s", err)
+	}
+	if config.Host != "https://192.168.99.100:8443" || config.Namespace != "default" {
+		t.Fatalf("Unexpected config: %#v", config)
+	}
+	if string(config.CAData) != string(ca) || len(config.ClientCertificates) != 1 {
+		t.Fatalf("Expected the CA and client certificate to be read: %#v", config)
+	}
+
+	// A selected context with inline data and a token
+	config, err = loadKubeconfig([]string{path}, "ci")
+	if err != nil {
+		t.Fatalf("Error loading kubeconfig: %s", err)
+	}
+	if config.Host != "https://production.example.com:6443" || config.Namespace != "certs" || config.Token != "ci-token" {
+		t.Fatalf("Unexpected config: %#v", config)
+	}
+	if string(config.CAData) != string(ca) || len(config.ClientCertificates) != 0 {
+		t.Fatalf("Expected the inline CA data to be read: %#v", config)
+	}
+
+	_, err = loadKubeconfig([]string{path}, "staging")
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown context")
+	}
+}
+
+const testStagingKubeconfig = `apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: staging
+- name: ci
+  context:
+    cluster: staging
+    user: staging
+users:
+- name: staging
+  user:
+    tokenFile: token
+`
+
+func TestLoadKubeconfigMerged(t *testing.T) {
+	path, _ := writeTestKubeconfig(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	stagingPath := filepath.Join(dir, "staging")
+	ioutil.WriteFile(stagingPath, []byte(testStagingKubeconfig), 0600)
+
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	os.Setenv("KUBECONFIG", strings.Join([]string{path, filepath.Join(dir, "missing"), stagingPath}, string(filepath.ListSeparator)))
+	paths := kubeconfigPaths()
+	if len(paths) != 3 {
+		t.Fatalf("Expected every file of `KUBECONFIG`: %v", paths)
+	}
+
+	// The first file defining the current context or a context wins
+	config, err := loadKubeconfig(paths, "")
+	if err != nil || config.Host != "https://192.168.99.100:8443" {
+		t.Fatalf("Expected the current context of the first file: %#v %v", config, err)
+	}
+	config, err = loadKubeconfig(paths, "ci")
+	if err != nil || config.Host != "https://production.example.com:6443" || config.Token != "ci-token" {
+		t.Fatalf("Expected the context of the first file: %#v %v", config, err)
+	}
+
+	// Contexts of later files, with files relative to their kubeconfig
+	config, err = loadKubeconfig(paths, "staging")
+	if err != nil || config.Host != "https://staging.example.com" || config.TokenFile != filepath.Join(dir, "token") {
+		t.Fatalf("Expected the context of the second file: %#v %v", config, err)
+	}
+
+	if _, err = loadKubeconfig([]string{filepath.Join(dir, "missing")}, ""); err == nil {
+		t.Fatalf("Expected an error for a missing kubeconfig")
+	}
+}
+
+func TestLoadKubernetesConfigNamespaceOverride(t *testing.T) {
+	path, _ := writeTestKubeconfig(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	defer func() {
+		KUBECONFIG_PATH = ""
+		KUBE_CONTEXT = ""
+		NAMESPACE_OVERRIDE = ""
+	}()
+	KUBECONFIG_PATH = path
+	KUBE_CONTEXT = "ci"
+	config, err := loadKubernetesConfig()
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	if config.Namespace != "certs" {
+		t.Fatalf("Expected the namespace of the context: %s", config.Namespace)
+	}
+	NAMESPACE_OVERRIDE = "other"
+	config, err = loadKubernetesConfig()
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	if config.Namespace != "other" {
+		t.Fatalf("Expected `--namespace` to override the context: %s", config.Namespace)
+	}
+}
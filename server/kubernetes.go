@@ -3,28 +3,40 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type SecretUpdateTemplate struct {
 	Kind       string            `json:"kind"`
 	ApiVersion string            `json:"apiVersion"`
 	Metadata   map[string]string `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
 	Data       map[string]string `json:"data"`
 }
 
 func NewSecretUpdate(name string, data map[string]string) (SecretUpdateTemplate, error) {
 	namespace, err := getNamespace()
-	log.Printf("Saving updates: %s, %s", data, namespace)
 	if err != nil {
 		return SecretUpdateTemplate{}, err
 	}
+	return NewNamespacedSecretUpdate(namespace, name, data), nil
+}
+
+func NewNamespacedSecretUpdate(namespace string, name string, data map[string]string) SecretUpdateTemplate {
+	log.Printf("Saving updates for keys %s in %s/%s", keys(data), namespace, name)
 	metadata := make(map[string]string)
 	metadata["name"] = name
 	metadata["namespace"] = namespace
@@ -33,73 +45,445 @@ func NewSecretUpdate(name string, data map[string]string) (SecretUpdateTemplate,
 		ApiVersion: "v1",
 		Metadata:   metadata,
 		Data:       data,
-	}, nil
+	}
 }
 
 var NAMESPACE_LOCATION = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 var TOKEN_LOCATION = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+var CA_LOCATION = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
 
-func getNamespace() (string, error) {
+// Set through the `--kubeconfig`, `--context` and `--namespace` flags
+var KUBECONFIG_PATH = ""
+var KUBE_CONTEXT = ""
+var NAMESPACE_OVERRIDE = ""
+
+// KubernetesConfig holds how to connect to the API server, either from the
+// service account of the pod or from a kubeconfig
+type KubernetesConfig struct {
+	// e.g. `https://10.0.0.1:443`
+	Host      string
+	Namespace string
+	// Bearer token, or the file it is read from for every request since bound
+	// service account tokens are rotated by the kubelet
+	Token     string
+	TokenFile string
+	Username  string
+	Password  string
+	// PEM encoded CA bundle used to verify the API server
+	CAData                []byte
+	ClientCertificates    []tls.Certificate
+	InsecureSkipTLSVerify bool
+}
+
+// inClusterConfig reads the service account mounted into the pod
+func inClusterConfig() (*KubernetesConfig, error) {
+	kubernestsHost := os.Getenv("KUBERNETES_SERVICE_HOST")
+	if kubernestsHost == "" {
+		return nil, errors.New("No `KUBERNETES_SERVICE_HOST` defined")
+	}
+	kubernetesPort := Getenv("KUBERNETES_SERVICE_PORT", "443")
+	config := &KubernetesConfig{
+		Host:                  fmt.Sprintf("https://%s", net.JoinHostPort(kubernestsHost, kubernetesPort)),
+		TokenFile:             TOKEN_LOCATION,
+		InsecureSkipTLSVerify: Getenv("KUBERNETES_INSECURE_SKIP_TLS_VERIFY", "") == "true",
+	}
 	log.Printf("Looking for kuberentes namespace in: %s", NAMESPACE_LOCATION)
-	fileData, err := ioutil.ReadFile(NAMESPACE_LOCATION)
-	var namespace string
+	namespace, err := ioutil.ReadFile(NAMESPACE_LOCATION)
 	if err != nil {
-		return namespace, err
+		return nil, err
+	}
+	config.Namespace = strings.TrimSpace(string(namespace))
+	if !config.InsecureSkipTLSVerify {
+		config.CAData, err = ioutil.ReadFile(CA_LOCATION)
+		if err != nil {
+			return nil, fmt.Errorf("Kubernetes CA certificate not found in %s: %s", CA_LOCATION, err)
+		}
 	}
-	namespace = string(fileData)
-	return namespace, nil
+	return config, nil
 }
 
-func getToken() (string, error) {
-	log.Printf("Looking for kuberentes token in: %s", TOKEN_LOCATION)
-	fileData, err := ioutil.ReadFile(TOKEN_LOCATION)
-	var namespace string
+// loadKubernetesConfig uses the kubeconfig if one is set explicitly
+// (`--kubeconfig` or `KUBECONFIG`), the service account when running in a pod
+// and `~/.kube/config` otherwise
+func loadKubernetesConfig() (*KubernetesConfig, error) {
+	var config *KubernetesConfig
+	var err error
+	if KUBECONFIG_PATH == "" && os.Getenv("KUBECONFIG") == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		config, err = inClusterConfig()
+	} else {
+		config, err = loadKubeconfig(kubeconfigPaths(), KUBE_CONTEXT)
+	}
 	if err != nil {
-		return namespace, err
+		return nil, err
+	}
+	if NAMESPACE_OVERRIDE != "" {
+		config.Namespace = NAMESPACE_OVERRIDE
 	}
-	namespace = string(fileData)
-	return namespace, nil
+	return config, nil
 }
 
-func updateSecret(secretName string, update SecretUpdateTemplate) error {
+// Connection shared by all requests to the API server. Created on first use.
+var kubernetesConfig *KubernetesConfig
+var kubernetesHTTPClient *http.Client
+var kubernetesClientLock sync.Mutex
+
+func kubernetesClient() (*KubernetesConfig, *http.Client, error) {
+	kubernetesClientLock.Lock()
+	defer kubernetesClientLock.Unlock()
+	if kubernetesHTTPClient != nil {
+		return kubernetesConfig, kubernetesHTTPClient, nil
+	}
+	config, err := loadKubernetesConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: config.ClientCertificates}
+	if config.InsecureSkipTLSVerify {
+		log.Printf("WARNING: Not verifying the certificate of the Kubernetes API server")
+		tlsConfig.InsecureSkipVerify = true
+	} else if len(config.CAData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(config.CAData) {
+			return nil, nil, errors.New("No certificates found in the Kubernetes CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	kubernetesConfig = config
+	kubernetesHTTPClient = &http.Client{
+		// No timeout on the client since watches are long-running requests
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			MaxIdleConnsPerHost:   10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+	return kubernetesConfig, kubernetesHTTPClient, nil
+}
+
+// getNamespace returns the namespace the server operates in: `--namespace`,
+// the namespace of the pod or the one of the kubeconfig context
+func getNamespace() (string, error) {
+	config, _, err := kubernetesClient()
+	if err != nil {
+		return "", err
+	}
+	return config.Namespace, nil
+}
+
+func newKubernetesRequest(config *KubernetesConfig, method string, path string, contentType string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, config.Host+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, */*")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	token := config.Token
+	if config.TokenFile != "" {
+		fileData, err := ioutil.ReadFile(config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Kubernetes token not found in %s: %s", config.TokenFile, err)
+		}
+		token = strings.TrimSpace(string(fileData))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else if config.Username != "" {
+		req.SetBasicAuth(config.Username, config.Password)
+	}
+	return req, nil
+}
+
+func kubernetesRequest(method string, path string, contentType string, body []byte) (int, []byte, error) {
+	config, client, err := kubernetesClient()
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := newKubernetesRequest(config, method, path, contentType, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+// kubernetesStream opens a long-running GET request (e.g. a watch) and returns
+// its body. The caller is responsible for closing it.
+func kubernetesStream(path string) (io.ReadCloser, error) {
+	config, client, err := kubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := newKubernetesRequest(config, "GET", path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Request to %s did not return 200 (Status Code: %d): %s", path, resp.StatusCode, string(body))
+	}
+	return resp.Body, nil
+}
+
+// Secret is a v1 Secret as returned by the API server
+type Secret struct {
+	Kind       string            `json:"kind,omitempty"`
+	ApiVersion string            `json:"apiVersion,omitempty"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+// Labels set on every secret created by the server
+var SECRET_LABELS = map[string]string{
+	"app": "auto-kubernetes-lets-encrypt",
+}
+
+func secretPath(namespace string, secretName string) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, secretName)
+}
+
+// getSecret returns the decoded data of a secret in the current namespace
+func getSecret(secretName string) (map[string][]byte, error) {
 	namespace, err := getNamespace()
+	if err != nil {
+		return nil, err
+	}
+	return getNamespacedSecret(namespace, secretName)
+}
+
+func getNamespacedSecret(namespace string, secretName string) (map[string][]byte, error) {
+	secret, err := lookupSecret(namespace, secretName)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("Secret `%s` not found in namespace `%s`", secretName, namespace)
+	}
+	data := make(map[string][]byte)
+	for key, value := range secret.Data {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding key `%s` in secret `%s`: %s", key, secretName, err)
+		}
+		data[key] = decoded
+	}
+	return data, nil
+}
+
+// lookupSecret returns the secret, or nil if it doesn't exist
+func lookupSecret(namespace string, secretName string) (*Secret, error) {
+	statusCode, body, err := kubernetesRequest("GET", secretPath(namespace, secretName), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 404 {
+		return nil, nil
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("Getting secret `%s` did not return 200 (Status Code: %d): %s", secretName, statusCode, string(body))
+	}
+	secret := &Secret{}
+	err = json.Unmarshal(body, secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// ConfigMap is a v1 ConfigMap as returned by the API server
+type ConfigMap struct {
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+	BinaryData map[string]string `json:"binaryData,omitempty"`
+}
+
+// getConfigMap returns the data of a config map, with its binary data decoded
+func getConfigMap(namespace string, name string) (map[string][]byte, error) {
+	statusCode, body, err := kubernetesRequest("GET", fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", namespace, name), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode == 404 {
+		return nil, fmt.Errorf("ConfigMap `%s` not found in namespace `%s`", name, namespace)
+	}
+	if statusCode != 200 {
+		return nil, fmt.Errorf("Getting config map `%s` did not return 200 (Status Code: %d): %s", name, statusCode, string(body))
+	}
+	configMap := ConfigMap{}
+	err = json.Unmarshal(body, &configMap)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte)
+	for key, value := range configMap.Data {
+		data[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding key `%s` in config map `%s`: %s", key, name, err)
+		}
+		data[key] = decoded
+	}
+	return data, nil
+}
+
+// ErrSecretConflict is returned when a secret was created or changed
+// concurrently
+var ErrSecretConflict = errors.New("Secret was changed concurrently")
+
+func createSecret(secret Secret) error {
+	secret.Kind = "Secret"
+	secret.ApiVersion = "v1"
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets", secret.Metadata.Namespace)
+	jsonStr, err := json.Marshal(secret)
 	if err != nil {
 		return err
 	}
-	token, err := getToken()
+	statusCode, body, err := kubernetesRequest("POST", path, "application/json", jsonStr)
 	if err != nil {
 		return err
 	}
-	kubernestsHost := os.Getenv("KUBERNETES_SERVICE_HOST")
-	if kubernestsHost == "" {
-		return errors.New("No `KUBERNETES_SERVICE_HOST` defined")
+	log.Printf("Response from API: %d, keys %s", statusCode, keys(secret.Data))
+	if statusCode == 409 {
+		return ErrSecretConflict
 	}
-	url := fmt.Sprintf("https://%s/api/v1/namespaces/%s/secrets/%s", kubernestsHost, namespace, secretName)
-	jsonStr, err := json.Marshal(update)
+	if statusCode != 201 {
+		return fmt.Errorf("Creating secret `%s` did not return 201 (Status Code: %d): %s", secret.Metadata.Name, statusCode, string(body))
+	}
+	return nil
+}
+
+// ensureSecret creates the secret with the given type (and owner, if any) if
+// it doesn't exist yet. An existing secret must be of the same type, since the
+// type of a secret can't be changed.
+func ensureSecret(namespace string, secretName string, secretType string, owner *OwnerReference) error {
+	secret, err := lookupSecret(namespace, secretName)
 	if err != nil {
 		return err
 	}
-	req, _ := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonStr))
-	authorizationHeader := fmt.Sprintf("Bearer %s", token)
-	req.Header.Set("Accept", "application/json, */*")
-	req.Header.Set("Content-Type", "application/strategic-merge-patch+json")
-	req.Header.Set("Authorization", authorizationHeader)
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	if secret != nil {
+		if secret.Type != secretType {
+			return fmt.Errorf("Secret `%s` has type `%s` instead of `%s`", secretName, secret.Type, secretType)
+		}
+		return nil
 	}
-	client := &http.Client{Transport: tr}
-	resp, err := client.Do(req)
+	log.Printf("Secret `%s` not found in namespace `%s`. Creating it.", secretName, namespace)
+	secret = &Secret{
+		Metadata: ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels:    SECRET_LABELS,
+		},
+		Type: secretType,
+		Data: make(map[string]string),
+	}
+	if owner != nil {
+		secret.Metadata.OwnerReferences = []OwnerReference{*owner}
+	}
+	if secretType == SECRET_TYPE_TLS {
+		// Required by the API server for this type
+		secret.Data["tls.crt"] = ""
+		secret.Data["tls.key"] = ""
+	}
+	return createSecret(*secret)
+}
+
+// patchSecret sets the keys of an existing secret if its resource version is
+// still the given one
+func patchSecret(namespace string, secretName string, resourceVersion string, data map[string]string) error {
+	patch := Secret{
+		Metadata: ObjectMeta{Name: secretName, ResourceVersion: resourceVersion},
+		Data:     data,
+	}
+	jsonStr, err := json.Marshal(patch)
 	if err != nil {
 		return err
 	}
-	log.Printf("Test 3")
-	defer resp.Body.Close()
-	log.Printf("Test 3.1")
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Printf("Test 4")
-	log.Printf("Response from API: %s, %s", resp.StatusCode, string(body))
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("User registration did not return 200 (Status Code: %s): %s", resp.StatusCode, string(body))
+	statusCode, body, err := kubernetesRequest("PATCH", secretPath(namespace, secretName), "application/strategic-merge-patch+json", jsonStr)
+	if err != nil {
+		return err
+	}
+	if statusCode == 409 {
+		return ErrSecretConflict
+	}
+	if statusCode != 200 {
+		return fmt.Errorf("Patching secret `%s` did not return 200 (Status Code: %d): %s", secretName, statusCode, string(body))
+	}
+	return nil
+}
+
+// annotateSecret sets annotations on an existing secret
+func annotateSecret(namespace string, secretName string, annotations map[string]string) error {
+	patch := Secret{
+		Metadata: ObjectMeta{Name: secretName, Annotations: annotations},
+	}
+	jsonStr, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	statusCode, body, err := kubernetesRequest("PATCH", secretPath(namespace, secretName), "application/strategic-merge-patch+json", jsonStr)
+	if err != nil {
+		return err
+	}
+	if statusCode != 200 {
+		return fmt.Errorf("Annotating secret `%s` did not return 200 (Status Code: %d): %s", secretName, statusCode, string(body))
+	}
+	return nil
+}
+
+// updateSecret patches the secret with the update, or creates it if it
+// doesn't exist
+func updateSecret(secretName string, update SecretUpdateTemplate) error {
+	namespace := update.Metadata["namespace"]
+	existing, err := lookupSecret(namespace, secretName)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return createSecret(Secret{
+			Metadata: ObjectMeta{
+				Name:      secretName,
+				Namespace: namespace,
+				Labels:    SECRET_LABELS,
+			},
+			Type: update.Type,
+			Data: update.Data,
+		})
+	}
+	jsonStr, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	statusCode, body, err := kubernetesRequest("PATCH", secretPath(namespace, secretName), "application/strategic-merge-patch+json", jsonStr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Response from API: %d, keys %s", statusCode, keys(update.Data))
+	if statusCode != 200 {
+		return fmt.Errorf("Updating secret `%s` did not return 200 (Status Code: %d): %s", secretName, statusCode, string(body))
 	}
 	return nil
 
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSecretsServer is an API server that only knows about secrets
+type fakeSecretsServer struct {
+	sync.Mutex
+	secrets  map[string]Secret
+	requests []string
+	// Called before a secret is created or patched, e.g. to simulate another
+	// process changing it concurrently
+	beforeWrite func(f *fakeSecretsServer, path string)
+}
+
+func (f *fakeSecretsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.Method {
+	case "GET":
+		secret, ok := f.secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case "POST":
+		secret := Secret{}
+		json.Unmarshal(body, &secret)
+		path := r.URL.Path + "/" + secret.Metadata.Name
+		if f.beforeWrite != nil {
+			f.beforeWrite(f, path)
+		}
+		if _, ok := f.secrets[path]; ok {
+			w.WriteHeader(409)
+			return
+		}
+		secret.Metadata.ResourceVersion = "1"
+		f.secrets[path] = secret
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(secret)
+	case "PATCH":
+		if f.beforeWrite != nil {
+			f.beforeWrite(f, r.URL.Path)
+		}
+		secret, ok := f.secrets[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		update := Secret{}
+		json.Unmarshal(body, &update)
+		if update.Metadata.ResourceVersion != "" && update.Metadata.ResourceVersion != secret.Metadata.ResourceVersion {
+			w.WriteHeader(409)
+			return
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string]string)
+		}
+		for key, value := range update.Data {
+			secret.Data[key] = value
+		}
+		if len(update.Metadata.Annotations) > 0 && secret.Metadata.Annotations == nil {
+			secret.Metadata.Annotations = make(map[string]string)
+		}
+		for key, value := range update.Metadata.Annotations {
+			secret.Metadata.Annotations[key] = value
+		}
+		secret.Metadata.ResourceVersion += "+"
+		f.secrets[r.URL.Path] = secret
+		json.NewEncoder(w).Encode(secret)
+	}
+}
+
+// withFakeSecretsServer points the kubernetes client at the fake server,
+// trusting its certificate like the service account CA
+func withFakeSecretsServer(t *testing.T, fake *fakeSecretsServer, test func()) {
+	withFakeKubernetesServer(t, fake, test)
+}
+
+// withFakeKubernetesServer points the kubernetes client at a server with the
+// handler
+func withFakeKubernetesServer(t *testing.T, handler http.Handler, test func()) {
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	token := writeTempFile(t, "token", []byte("token\n"))
+	defer os.Remove(token)
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	ca := writeTempFile(t, "ca.crt", caData)
+	defer os.Remove(ca)
+
+	namespace := writeTempFile(t, "namespace", []byte("default"))
+	defer os.Remove(namespace)
+
+	defer func(location string) { TOKEN_LOCATION = location }(TOKEN_LOCATION)
+	TOKEN_LOCATION = token
+	defer func(location string) { NAMESPACE_LOCATION = location }(NAMESPACE_LOCATION)
+	NAMESPACE_LOCATION = namespace
+	defer func(location string) { CA_LOCATION = location }(CA_LOCATION)
+	CA_LOCATION = ca
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	defer os.Setenv("KUBERNETES_SERVICE_HOST", os.Getenv("KUBERNETES_SERVICE_HOST"))
+	os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	defer os.Setenv("KUBERNETES_SERVICE_PORT", os.Getenv("KUBERNETES_SERVICE_PORT"))
+	os.Setenv("KUBERNETES_SERVICE_PORT", port)
+	resetKubernetesClient()
+	defer resetKubernetesClient()
+	test()
+}
+
+func resetKubernetesClient() {
+	kubernetesConfig = nil
+	kubernetesHTTPClient = nil
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	file, err := ioutil.TempFile("", name)
+	if err != nil {
+		t.Fatalf("Error creating %s: %s", name, err)
+	}
+	defer file.Close()
+	file.Write(data)
+	return file.Name()
+}
+
+// selfSignedCertificate returns a PEM encoded self-signed certificate for the
+// domains, expiring at `notAfter`, and its key. Without domains it's a CA
+// certificate.
+func selfSignedCertificate(t *testing.T, domains []string, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1234),
+		Subject:      pkix.Name{CommonName: "other-ca"},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	if len(domains) > 0 {
+		template.Subject.CommonName = domains[0]
+	} else {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestKubernetesClientVerifiesServerCertificate(t *testing.T) {
+	fake := &fakeSecretsServer{secrets: make(map[string]Secret)}
+	withFakeSecretsServer(t, fake, func() {
+		_, err := lookupSecret("default", "example")
+		if err != nil {
+			t.Fatalf("Error with the trusted CA: %s", err)
+		}
+		if len(fake.requests) != 1 {
+			t.Fatalf("Expected one request: %v", fake.requests)
+		}
+
+		// A CA that didn't sign the certificate of the server
+		otherCA, _ := selfSignedCertificate(t, nil, time.Now().Add(time.Hour))
+		CA_LOCATION = writeTempFile(t, "other-ca.crt", otherCA)
+		defer os.Remove(CA_LOCATION)
+		resetKubernetesClient()
+		_, err = lookupSecret("default", "example")
+		if err == nil {
+			t.Fatalf("Expected an error for an untrusted server certificate")
+		}
+		if len(fake.requests) != 1 {
+			t.Fatalf("Request reached an untrusted server: %v", fake.requests)
+		}
+
+		os.Setenv("KUBERNETES_INSECURE_SKIP_TLS_VERIFY", "true")
+		defer os.Unsetenv("KUBERNETES_INSECURE_SKIP_TLS_VERIFY")
+		resetKubernetesClient()
+		_, err = lookupSecret("default", "example")
+		if err != nil {
+			t.Fatalf("Error with verification turned off: %s", err)
+		}
+	})
+}
+
+func TestEnsureSecretCreatesMissingSecret(t *testing.T) {
+	fake := &fakeSecretsServer{secrets: make(map[string]Secret)}
+	owner := &OwnerReference{ApiVersion: "lets-encrypt.thejsj.com/v1alpha1", Kind: "Certificate", Name: "example", UID: "1234"}
+	withFakeSecretsServer(t, fake, func() {
+		err := ensureSecret("default", "example-tls", SECRET_TYPE_TLS, owner)
+		if err != nil {
+			t.Fatalf("Error ensuring secret: %s", err)
+		}
+		// Existing secrets are left alone
+		err = ensureSecret("default", "example-tls", SECRET_TYPE_TLS, owner)
+		if err != nil {
+			t.Fatalf("Error ensuring secret: %s", err)
+		}
+		err = ensureSecret("default", "example-tls", SECRET_TYPE_OPAQUE, nil)
+		if err == nil {
+			t.Fatalf("Expected an error for a secret of another type")
+		}
+	})
+	created, ok := fake.secrets["/api/v1/namespaces/default/secrets/example-tls"]
+	if !ok {
+		t.Fatalf("Secret was not created: %v", fake.requests)
+	}
+	if created.Type != SECRET_TYPE_TLS || created.Metadata.Labels["app"] != "auto-kubernetes-lets-encrypt" {
+		t.Fatalf("Unexpected secret: %#v", created)
+	}
+	if len(created.Metadata.OwnerReferences) != 1 || created.Metadata.OwnerReferences[0].UID != "1234" {
+		t.Fatalf("Expected the owner to be set: %#v", created.Metadata)
+	}
+	posts := 0
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "POST") {
+			posts++
+		}
+	}
+	if posts != 1 {
+		t.Fatalf("Expected a single POST: %v", fake.requests)
+	}
+}
+
+func TestUpdateSecretPatchesExistingSecret(t *testing.T) {
+	fake := &fakeSecretsServer{secrets: map[string]Secret{
+		"/api/v1/namespaces/default/secrets/existing": {
+			Metadata: ObjectMeta{Name: "existing", Namespace: "default"},
+			Type:     SECRET_TYPE_OPAQUE,
+			Data:     map[string]string{"private_key": "a2V5"},
+		},
+	}}
+	// Secrets are never logged
+	output := &bytes.Buffer{}
+	log.SetOutput(output)
+	defer log.SetOutput(os.Stderr)
+	withFakeSecretsServer(t, fake, func() {
+		err := updateSecret("existing", NewNamespacedSecretUpdate("default", "existing", map[string]string{"registration": "e30="}))
+		if err != nil {
+			t.Fatalf("Error updating secret: %s", err)
+		}
+		err = updateSecret("missing", NewNamespacedSecretUpdate("default", "missing", map[string]string{"registration": "e30="}))
+		if err != nil {
+			t.Fatalf("Error updating secret: %s", err)
+		}
+		data, err := getNamespacedSecret("default", "existing")
+		if err != nil {
+			t.Fatalf("Error getting secret: %s", err)
+		}
+		if string(data["private_key"]) != "key" || string(data["registration"]) != "{}" {
+			t.Fatalf("Unexpected secret data: %v", data)
+		}
+	})
+	if _, ok := fake.secrets["/api/v1/namespaces/default/secrets/missing"]; !ok {
+		t.Fatalf("Missing secret was not created: %v", fake.requests)
+	}
+	for _, request := range fake.requests {
+		if request == "PATCH /api/v1/namespaces/default/secrets/missing" {
+			t.Fatalf("Missing secret was patched: %v", fake.requests)
+		}
+	}
+	if strings.Contains(output.String(), "a2V5") || strings.Contains(output.String(), "e30=") {
+		t.Fatalf("Expected the secret data not to be logged: %s", output.String())
+	}
+}
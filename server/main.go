@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,11 +12,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/xenolf/lego/acme"
-	"github.com/xenolf/lego/providers/http/webroot"
 )
 
 type HealthResponse struct {
@@ -40,51 +38,31 @@ var WEBROOT_LOCATION = "/var/www/"
 var IN_PROGRESS = false
 var currentHealthId string = ""
 
-func generate() error {
+func generate(targets []CertificateTarget) error {
+	return issue(targets, obtainCertificate)
+}
+
+func renew(targets []CertificateTarget) error {
+	return issue(targets, ensureCertificate)
+}
+
+func issue(targets []CertificateTarget, issueCert func(target CertificateTarget, email string) (acme.CertificateResource, error)) error {
 	if IN_PROGRESS {
 		return fmt.Errorf("Already in Progress")
 	}
 	IN_PROGRESS = true
+	defer func() { IN_PROGRESS = false }()
 
 	log.Printf("Start main handler...")
-	// TODO: Add validation for these
-	domainsRaw := Getenv("DOMAINS", "")
 	// TODO: Add email validation
 	email := Getenv("EMAIL", "")
-	// TODO: Make sure secret exists
-	secretName := Getenv("SECRET_NAME", "")
-
-	envInputs := make(map[string]string)
-	envInputs["DOMAINS"] = domainsRaw
-	envInputs["EMAIL"] = email
-	envInputs["SECRET_NAME"] = secretName
-	log.Printf("ENV inputs: %s", envInputs)
-	if domainsRaw == "" || email == "" || secretName == "" {
-		log.Printf("Environment variables not setup correctly: %s", envInputs)
-		return fmt.Errorf("The following ENV variables are required: `DOMAINS`, `EMAIL`, and `SECRET_NAME`: %s", envInputs)
-	}
-	// Get namespce
-	log.Printf("Looking for kuberentes namespace in: %s", NAMESPACE_LOCATION)
-	namespace, err := getNamespace()
-	if err != nil {
-		log.Printf("Kubernetes namespace not found in %s", NAMESPACE_LOCATION)
-		return fmt.Errorf("Kubernetes namespace not found in %s", NAMESPACE_LOCATION)
+	if email == "" {
+		return fmt.Errorf("The ENV variable `EMAIL` is required")
 	}
-	log.Printf("Kubernetes namespace used: %s", namespace)
 	log.Printf("Starting cert manager. Placing certs in: %s", CERTS_LOCATION)
-	// Generate certiticates
-	domains := strings.Split(domainsRaw, ",")
-	for i := 0; i < len(domains); i++ {
-		domains[i] = strings.Trim(domains[i], " ")
-	}
-	log.Printf("Cert location", CERTS_LOCATION)
-	certErr := GenerateCerts(domains, email)
-	if certErr != nil {
-		log.Printf("Cert err: %s", certErr)
-		return fmt.Errorf("Cannot get user registration. User has not be registered or registration cannot be properly retrieved.")
-	}
-	IN_PROGRESS = false
-	return nil
+	return issueTargets(targets, email, func(target CertificateTarget, email string) (acme.CertificateResource, error) {
+		return issueWithFailover(target, email, issueCert)
+	})
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -96,102 +74,169 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func register() error {
-	email := Getenv("EMAIL", "")
-	legoUser, err := getUser(email)
+	_, err := ensureRegistration(Getenv("EMAIL", ""))
+	return err
+}
+
+// CertificateTarget is a set of domains and the secret their certificate is
+// stored in
+type CertificateTarget struct {
+	Namespace  string
+	SecretName string
+	Domains    []string
+	// Optional settings. Empty values fall back to the environment variables
+	// and their defaults.
+	KeyType       acme.KeyType
+	ChallengeType string
+	DNSProvider   string
+	RenewBefore   time.Duration
+	// `legacy` or `tls`. See secret.go
+	Layout     string
+	LegacyKeys bool
+	// Issue the certificate for this CSR instead of generating a private key
+	CSR *CSRSource
+	// Leave out the domains that fail validation instead of failing
+	AllowPartial bool
+	// Set as the owner of the secret if it's created
+	Owner *OwnerReference
+}
+
+// ObtainError holds the failures returned by the ACME server for each domain
+type ObtainError struct {
+	Failures map[string]error
+}
+
+func (e ObtainError) Error() string {
+	return fmt.Sprintf("More than 0 failures when generating certs: %s", e.Failures)
+}
+
+// envCertificateTarget returns the target configured through `SECRET_NAME`
+// in the current namespace
+func envCertificateTarget(domains []string) (CertificateTarget, error) {
+	secretName := Getenv("SECRET_NAME", "")
+	if secretName == "" {
+		return CertificateTarget{}, errors.New("Environment variable `SECRET_NAME` required")
+	}
+	namespace, err := getNamespace()
 	if err != nil {
-		return err
+		return CertificateTarget{}, err
 	}
-	_, err = registerUser(legoUser)
+	csrSource, err := envCSRSource()
 	if err != nil {
-		return err
+		return CertificateTarget{}, err
 	}
-	return nil
+	return CertificateTarget{
+		Namespace:  namespace,
+		SecretName: secretName,
+		Domains:    domains,
+		CSR:        csrSource,
+	}, nil
 }
 
-func GenerateCerts(domains []string, email string) error {
+func obtainCertificate(target CertificateTarget, email string) (acme.CertificateResource, error) {
+	if target.CSR != nil {
+		return obtainCertificateForCSR(target, email)
+	}
+	err := prepareSecret(target)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
 	legoUser, err := getUserWithRegistration(email)
 	if err != nil {
 		log.Printf("Error getting user with registration: %s", err)
-		return err
+		return acme.CertificateResource{}, err
 	}
-	secretName := Getenv("SECRET_NAME", "")
-	if secretName == "" {
-		return errors.New("Environment variable `LETS_ENCRYPT_USER_SECRET_NAME` required")
+	client, err := newAcmeClient(legoUser, target)
+	if err != nil {
+		return acme.CertificateResource{}, err
 	}
+	bundle := false
+	log.Printf("Obtaining certificates for %s...", target.Domains)
+	certificates, failures := client.ObtainCertificate(target.Domains, bundle, nil, false)
+	log.Printf("%d failures founds", len(failures))
+	var excluded map[string]error
+	if len(failures) > 0 && allowPartial(target) {
+		certificates, excluded, failures = obtainValidatedDomains(client, target, failures)
+	}
+	if len(failures) > 0 {
+		log.Printf("Too many failures: %s", failures)
+		return acme.CertificateResource{}, ObtainError{Failures: failures}
+	}
+	err = saveCertificates(target, certificates)
+	if err != nil || !allowPartial(target) {
+		return certificates, err
+	}
+	return certificates, recordExcludedDomains(target, excluded)
+}
 
+func newAcmeClient(legoUser LegoUser, target CertificateTarget) (ACMEClient, error) {
 	// https://github.com/xenolf/lego/blob/master/cli.go#L120
-	caServerHost := Getenv("CA_SERVER", "https://acme-v01.api.letsencrypt.org/directory")
+	caServerHost := caServer()
 	log.Printf("Creating new user from CA server: %s", caServerHost)
-	client, err := acme.NewClient(caServerHost, &legoUser, acme.RSA2048)
+	keyType, err := certificateKeyType(target)
+	if err != nil {
+		return nil, err
+	}
+	if keyType == "" {
+		keyType = acme.RSA2048
+	}
+	client, err := connectACMEServer(caServerHost, legoUser, keyType)
 	if err != nil {
 		log.Printf("Error creating acme client: %s", err)
-		return err
+		return nil, err
 	}
 
-	log.Printf("Setting webroot provider at %s", WEBROOT_LOCATION)
-	provider, err := webroot.NewHTTPProvider(WEBROOT_LOCATION)
+	challengeType := target.ChallengeType
+	if challengeType == "" {
+		challengeType = Getenv("CHALLENGE_TYPE", HTTP_01_CHALLENGE)
+	}
+	dnsProvider := target.DNSProvider
+	if dnsProvider == "" {
+		dnsProvider = Getenv("DNS_PROVIDER", "")
+	}
+	err = setChallengeProvider(client, challengeType, dnsProvider)
 	if err != nil {
-		log.Printf("Error creating acme client provider: %s", err)
-		return err
+		return nil, err
 	}
-	log.Printf("Setting challenge provider to HTTP")
-	client.SetChallengeProvider(acme.HTTP01, provider)
-	log.Printf("Excluding all other challenges")
-	client.ExcludeChallenges([]acme.Challenge{acme.DNS01, acme.TLSSNI01})
 
 	// New users will need to register
 	log.Printf("Agreeing to TOS")
 	err = client.AgreeToTOS()
 	if err != nil {
 		log.Printf("Error agreeing to terms of service: %s", err)
-		return err
-	}
-	bundle := false
-	log.Printf("Obtaining certificates...")
-	certificates, failures := client.ObtainCertificate(domains, bundle, nil, false)
-	log.Printf("%d failures founds", len(failures))
-	if len(failures) > 0 {
-		log.Printf("Too many failures: %s", failures)
-		return fmt.Errorf("More than 0 failures when generating certs: %s", failures)
+		return nil, err
 	}
+	return client, nil
+}
 
+func saveCertificates(target CertificateTarget, certificates acme.CertificateResource) error {
 	// Each certificate comes back with the cert bytes, the bytes of the client's
 	// private key, and a certificate URL. SAVE THESE TO DISK.
-	fmt.Printf("%#v\n", certificates)
-	log.Printf("Save certs to disk")
-	saveCertToDisk(certificates, "/etc/auto-kubernetes-lets-encrypt/certs/")
-
-	// Create updates for secret
-	domain := certificates.Domain
-	updates := make(map[string]string)
-	updates[domain+".crt"] = base64.StdEncoding.EncodeToString(certificates.Certificate)
-	updates[domain+".key"] = base64.StdEncoding.EncodeToString(certificates.PrivateKey)
-	pemKey := bytes.Join([][]byte{certificates.Certificate, certificates.PrivateKey}, nil)
-	updates[domain+".pem"] = base64.StdEncoding.EncodeToString(pemKey)
-	metadataJson, _ := json.MarshalIndent(certificates, "", "\t")
-	updates[domain+".json"] = base64.StdEncoding.EncodeToString(metadataJson)
-	updates[domain+".issuer.crt"] = base64.StdEncoding.EncodeToString(certificates.IssuerCertificate)
-
-	update, err := NewSecretUpdate(secretName, updates)
-	if err != nil {
-		return fmt.Errorf("Error creating new update for secret: %s", err)
+	log.Printf("Saving certificate for %s in secret `%s` (%s)", target.Domains, target.SecretName, certificates.CertURL)
+	certsDir := "/etc/auto-kubernetes-lets-encrypt/certs/"
+	if _, err := os.Stat(certsDir); err == nil {
+		log.Printf("Save certs to disk")
+		saveCertToDisk(certificates, certsDir)
+	} else {
+		// Not running in the image (e.g. with a kubeconfig)
+		log.Printf("Not saving certs to disk: %s", err)
 	}
-	err = updateSecret(secretName, update)
+
+	err := getStateStore().SaveCertificate(target, certificates)
 	if err != nil {
-		return fmt.Errorf("Error updating secret in kubernetes: %s", err)
+		return err
 	}
-
-	return nil
+	return annotateSecret(target.Namespace, target.SecretName, map[string]string{CA_SERVER_ANNOTATION: caServer()})
 }
 
 func saveCertToDisk(certificates acme.CertificateResource, certPath string) {
 	// We store the certificate, private key and metadata in different files
 	// as web servers would not be able to work with a combined file.
-	certOut := path.Join(certPath, certificates.Domain+".crt")
-	privOut := path.Join(certPath, certificates.Domain+".key")
-	pemOut := path.Join(certPath, certificates.Domain+".pem")
-	metaOut := path.Join(certPath, certificates.Domain+".json")
-	issuerOut := path.Join(certPath, certificates.Domain+".issuer.crt")
+	certOut := path.Join(certPath, domainKey(certificates.Domain)+".crt")
+	privOut := path.Join(certPath, domainKey(certificates.Domain)+".key")
+	pemOut := path.Join(certPath, domainKey(certificates.Domain)+".pem")
+	metaOut := path.Join(certPath, domainKey(certificates.Domain)+".json")
+	issuerOut := path.Join(certPath, domainKey(certificates.Domain)+".issuer.crt")
 
 	err := ioutil.WriteFile(certOut, certificates.Certificate, 0600)
 	if err != nil {
@@ -218,7 +263,7 @@ func saveCertToDisk(certificates acme.CertificateResource, certPath string) {
 		}
 	} else {
 		// we don't have the private key; can't write the .pem file
-		log.Fatalf("Unable to save pem without private key for domain %s\n\t%s; are you using a CSR?", certificates.Domain, err.Error())
+		log.Printf("Not saving PrivateKey and .pem for domain %s: the certificate was issued for a CSR", certificates.Domain)
 	}
 
 	jsonBytes, err := json.MarshalIndent(certificates, "", "\t")
@@ -246,39 +291,89 @@ func startServer() {
 }
 
 func main() {
+	flag.StringVar(&KUBECONFIG_PATH, "kubeconfig", "", "Path to a kubeconfig. Defaults to the files in $KUBECONFIG merged like kubectl does, or ~/.kube/config when not running in a pod")
+	flag.StringVar(&KUBE_CONTEXT, "context", "", "Context of the kubeconfig to use. Defaults to its current-context")
+	flag.StringVar(&NAMESPACE_OVERRIDE, "namespace", "", "Namespace to use instead of the one of the pod or kubeconfig context")
+	flag.Parse()
+
+	err := configureACMEHTTPClient()
+	if err != nil {
+		log.Printf("Error configuring the ACME HTTP client: %s", err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "render":
+		err := runRender(flag.Args()[1:])
+		if err != nil {
+			log.Printf("Error rendering resources: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "account":
+		err := runAccount(flag.Args()[1:])
+		if err != nil {
+			log.Printf("Error managing account: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "revoke":
+		err := runRevoke(flag.Args()[1:])
+		if err != nil {
+			log.Printf("Error revoking certificate: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "import-account":
+		err := runImportAccount(flag.Args()[1:])
+		if err != nil {
+			log.Printf("Error importing account: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	log.Printf("Start server")
 	go startServer()
 	log.Printf("Start IP lookup")
-	domain := Getenv("DOMAINS", "")
-	if domain == "" {
-		fmt.Printf("No `DOMAIN` provided as env: %s", domain)
+	mode := Getenv("MODE", "job")
+	if Getenv("DOMAINS", "") == "" && Getenv("CERTIFICATES", "") == "" && mode != "ingress" && mode != "certificate" {
+		fmt.Printf("No `DOMAINS` or `CERTIFICATES` provided as env")
 		os.Exit(1)
 	}
 
 	log.Printf("Start registring user")
-	err := register()
+	err = register()
 	if err != nil {
 		log.Printf("Error registring user: %s", err)
 		os.Exit(1)
 	}
 
-	retries := 0
-	for retries < 10 { // Add retry logic in order to workaround DNS resolution
-		time.Sleep(5000 * time.Millisecond)
-		log.Printf("Attempt to generate certs")
-		retries = retries + 1
-		err = generate()
-		if err != nil {
-			log.Printf("Error generating certs: %s", err)
-			continue
-		}
-		break
+	switch mode {
+	case "controller":
+		err = runController()
+		log.Printf("Error running renewal controller: %s", err)
+		os.Exit(1)
+	case "ingress":
+		err = runIngressController(Getenv("EMAIL", ""))
+		log.Printf("Error running ingress controller: %s", err)
+		os.Exit(1)
+	case "certificate":
+		err = runCertificateController(Getenv("EMAIL", ""))
+		log.Printf("Error running certificate controller: %s", err)
+		os.Exit(1)
 	}
 
-	if retries == 10 {
-		log.Printf("Exiting after attempting to generate certs 10 times")
+	targets, err := envCertificateTargets()
+	if err != nil {
+		log.Printf("Error reading certificates: %s", err)
 		os.Exit(1)
 	}
+	err = generateWithRetry(targets, generate)
+	if err != nil {
+		log.Printf("Error generating certs: %s", err)
+		os.Exit(exitCode(err))
+	}
 
 	log.Printf("Cert successfully created")
 	os.Exit(0)
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Annotations listing the domains left out of a partially issued certificate
+// and the errors returned by the ACME server for each of them (as JSON)
+var EXCLUDED_DOMAINS_ANNOTATION = "auto-kubernetes-lets-encrypt/excluded-domains"
+var EXCLUDED_DOMAIN_ERRORS_ANNOTATION = "auto-kubernetes-lets-encrypt/excluded-domain-errors"
+
+// allowPartial returns whether the certificate of the target is issued for
+// the domains that pass validation if others fail, falling back to
+// `ALLOW_PARTIAL`
+func allowPartial(target CertificateTarget) bool {
+	return target.AllowPartial || Getenv("ALLOW_PARTIAL", "") == "true"
+}
+
+// obtainValidatedDomains obtains the certificate again without the domains
+// that failed. It returns the certificate and the excluded domains, or the
+// failures if no certificate could be obtained.
+func obtainValidatedDomains(client ACMEClient, target CertificateTarget, failures map[string]error) (acme.CertificateResource, map[string]error, map[string]error) {
+	validated := []string{}
+	for _, domain := range target.Domains {
+		if _, failed := failures[domain]; !failed {
+			validated = append(validated, domain)
+		}
+	}
+	if len(validated) == 0 {
+		return acme.CertificateResource{}, nil, failures
+	}
+	log.Printf("Excluding %d failed domains. Obtaining certificates for %s...", len(target.Domains)-len(validated), validated)
+	certificates, retryFailures := client.ObtainCertificate(validated, false, nil, false)
+	if len(retryFailures) > 0 {
+		for domain, err := range failures {
+			retryFailures[domain] = err
+		}
+		return acme.CertificateResource{}, nil, retryFailures
+	}
+	return certificates, failures, nil
+}
+
+// recordExcludedDomains writes the excluded domains and their errors to the
+// annotations of the secret. They're cleared once no domain is excluded.
+func recordExcludedDomains(target CertificateTarget, excluded map[string]error) error {
+	domains := []string{}
+	errors := make(map[string]string)
+	for _, domain := range target.Domains {
+		if err, ok := excluded[domain]; ok {
+			domains = append(domains, domain)
+			errors[domain] = err.Error()
+		}
+	}
+	annotations := map[string]string{
+		EXCLUDED_DOMAINS_ANNOTATION:       strings.Join(domains, ","),
+		EXCLUDED_DOMAIN_ERRORS_ANNOTATION: "",
+	}
+	if len(domains) > 0 {
+		log.Printf("Certificate in secret `%s` excludes %s: %s", target.SecretName, domains, errors)
+		errorsJson, err := json.Marshal(errors)
+		if err != nil {
+			return err
+		}
+		annotations[EXCLUDED_DOMAIN_ERRORS_ANNOTATION] = string(errorsJson)
+	}
+	return annotateSecret(target.Namespace, target.SecretName, annotations)
+}
+
+// loadExcludedDomains returns the domains excluded from the certificate in
+// the secret of the target with their errors
+func loadExcludedDomains(target CertificateTarget) (map[string]string, error) {
+	secret, err := lookupSecret(target.Namespace, target.SecretName)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+	excluded := make(map[string]string)
+	for _, domain := range strings.Split(secret.Metadata.Annotations[EXCLUDED_DOMAINS_ANNOTATION], ",") {
+		if domain != "" {
+			excluded[domain] = ""
+		}
+	}
+	if errorsJson := secret.Metadata.Annotations[EXCLUDED_DOMAIN_ERRORS_ANNOTATION]; errorsJson != "" && len(excluded) > 0 {
+		errors := make(map[string]string)
+		err = json.Unmarshal([]byte(errorsJson), &errors)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing annotation `%s` of secret `%s`: %s", EXCLUDED_DOMAIN_ERRORS_ANNOTATION, target.SecretName, err)
+		}
+		for domain := range excluded {
+			excluded[domain] = errors[domain]
+		}
+	}
+	return excluded, nil
+}
+
+// issuedTarget returns the target without the domains excluded from its
+// certificate, i.e. the domains the stored certificate is expected to cover
+func issuedTarget(target CertificateTarget, excluded map[string]string) CertificateTarget {
+	domains := []string{}
+	for _, domain := range target.Domains {
+		if _, ok := excluded[domain]; !ok {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) > 0 {
+		target.Domains = domains
+	}
+	return target
+}
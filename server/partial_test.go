@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExcludedDomains(t *testing.T) {
+	certificate, key := selfSignedCertificate(t, []string{"example.com", "www.example.com"}, time.Now().Add(time.Hour))
+	path := "/api/v1/namespaces/default/secrets/example-tls"
+	fake := &fakeSecretsServer{
+		secrets: map[string]Secret{
+			path: {
+				Metadata: ObjectMeta{Name: "example-tls", Namespace: "default"},
+				Type:     SECRET_TYPE_TLS,
+				Data:     encodeSecretData(map[string][]byte{"tls.crt": certificate, "tls.key": key}),
+			},
+		},
+	}
+	target := CertificateTarget{
+		Namespace:    "default",
+		SecretName:   "example-tls",
+		Domains:      []string{"example.com", "broken.example.com", "www.example.com"},
+		Layout:       SECRET_LAYOUT_TLS,
+		AllowPartial: true,
+		RenewBefore:  time.Minute,
+	}
+	withFakeSecretsServer(t, fake, func() {
+		// Without the exclusions the certificate doesn't cover the domains
+		if _, action := inspectCertificate(target); action != OBTAIN_CERTIFICATE {
+			t.Fatalf("Expected a new certificate, got %s", action)
+		}
+
+		err := recordExcludedDomains(target, map[string]error{"broken.example.com": errors.New("NXDOMAIN looking up A for broken.example.com")})
+		if err != nil {
+			t.Fatalf("Error recording excluded domains: %s", err)
+		}
+		annotations := fake.secrets[path].Metadata.Annotations
+		if annotations[EXCLUDED_DOMAINS_ANNOTATION] != "broken.example.com" {
+			t.Fatalf("Unexpected annotations: %v", annotations)
+		}
+		errorsJson := map[string]string{}
+		json.Unmarshal([]byte(annotations[EXCLUDED_DOMAIN_ERRORS_ANNOTATION]), &errorsJson)
+		if errorsJson["broken.example.com"] != "NXDOMAIN looking up A for broken.example.com" {
+			t.Fatalf("Unexpected errors annotation: %s", annotations[EXCLUDED_DOMAIN_ERRORS_ANNOTATION])
+		}
+
+		excluded, err := loadExcludedDomains(target)
+		if err != nil || len(excluded) != 1 || excluded["broken.example.com"] == "" {
+			t.Fatalf("Unexpected excluded domains: %v %v", excluded, err)
+		}
+		if _, action := inspectCertificate(target); action != "" {
+			t.Fatalf("Expected the partial certificate to be kept, got %s", action)
+		}
+		// The excluded domains are attempted again with the renewal
+		target.RenewBefore = 24 * time.Hour
+		if _, action := inspectCertificate(target); action != OBTAIN_CERTIFICATE {
+			t.Fatalf("Expected a new certificate on renewal, got %s", action)
+		}
+
+		err = recordExcludedDomains(target, nil)
+		if err != nil {
+			t.Fatalf("Error clearing excluded domains: %s", err)
+		}
+		excluded, err = loadExcludedDomains(target)
+		if err != nil || len(excluded) != 0 {
+			t.Fatalf("Expected the excluded domains to be cleared: %v %v", excluded, err)
+		}
+	})
+}
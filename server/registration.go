@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// AccountClient makes the account requests the vendored lego client doesn't
+// support (updating the contact, deactivating and key changes) or whose
+// response it drops (the status of the account) against an ACME v1 server.
+// Against an ACME v2 server they're made with the ACME v2 client.
+type AccountClient struct {
+	directoryURL string
+	keyChangeURL string
+	key          crypto.PrivateKey
+	nonces       []string
+	v2           *ACMEv2Client
+}
+
+// AccountDetails is the registration object returned by the ACME server
+type AccountDetails struct {
+	ID        int      `json:"id"`
+	Contact   []string `json:"contact"`
+	Agreement string   `json:"agreement"`
+	Status    string   `json:"status"`
+	CreatedAt string   `json:"createdAt"`
+	// Link to the current terms of service
+	TosURL string `json:"-"`
+}
+
+func newAccountClient(directoryURL string, key crypto.PrivateKey) (*AccountClient, error) {
+	v2Directory, err := fetchACMEv2Directory(directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	if v2Directory != nil {
+		return &AccountClient{directoryURL: directoryURL, key: key, v2: newACMEv2Client(v2Directory, key, "", "")}, nil
+	}
+	resp, err := acme.HTTPClient.Get(directoryURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting directory %s: %s", directoryURL, err)
+	}
+	defer resp.Body.Close()
+	directory := struct {
+		KeyChange string `json:"key-change"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&directory)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing directory %s: %s", directoryURL, err)
+	}
+	return &AccountClient{directoryURL: directoryURL, keyChangeURL: directory.KeyChange, key: key}, nil
+}
+
+// Fetch returns the registration at `uri`
+func (c *AccountClient) Fetch(uri string) (AccountDetails, error) {
+	return c.updateRegistration(uri, map[string]interface{}{"resource": "reg"})
+}
+
+// UpdateContact replaces the contact of the registration
+func (c *AccountClient) UpdateContact(uri string, contact []string) (AccountDetails, error) {
+	return c.updateRegistration(uri, map[string]interface{}{"resource": "reg", "contact": contact})
+}
+
+// Deactivate deactivates the account. This can't be undone and its key can't
+// be used for another account.
+func (c *AccountClient) Deactivate(uri string) (AccountDetails, error) {
+	return c.updateRegistration(uri, map[string]interface{}{"resource": "reg", "status": "deactivated"})
+}
+
+func (c *AccountClient) updateRegistration(uri string, payload map[string]interface{}) (AccountDetails, error) {
+	if c.v2 != nil {
+		return c.updateAccount(uri, payload)
+	}
+	details := AccountDetails{}
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return details, err
+	}
+	header, err := c.post(uri, c.key, content, &details)
+	if err != nil {
+		return details, err
+	}
+	for _, link := range header["Link"] {
+		if strings.Contains(link, `rel="terms-of-service"`) {
+			details.TosURL = strings.Trim(strings.SplitN(link, ";", 2)[0], "<> ")
+		}
+	}
+	return details, nil
+}
+
+// ChangeKey rolls the account over to `newKey`. The request is signed with
+// the current key and carries a request signed with the new key, proving
+// the possession of both.
+func (c *AccountClient) ChangeKey(uri string, newKey crypto.PrivateKey) error {
+	if c.v2 != nil {
+		c.v2.accountURL = uri
+		err := c.v2.ChangeKey(newKey)
+		if err != nil {
+			return err
+		}
+		c.key = newKey
+		return nil
+	}
+	if c.keyChangeURL == "" {
+		return errors.New("The ACME server doesn't support key changes")
+	}
+	publicKey, err := accountPublicKey(newKey)
+	if err != nil {
+		return err
+	}
+	inner, err := json.Marshal(map[string]interface{}{
+		"resource": "key-change",
+		"account":  uri,
+		"newKey":   jose.JsonWebKey{Key: publicKey},
+	})
+	if err != nil {
+		return err
+	}
+	signed, err := c.sign(newKey, inner)
+	if err != nil {
+		return err
+	}
+	// The outer payload is the inner JWS, which the server also checks for
+	// the resource it's meant for
+	outer := map[string]interface{}{}
+	err = json.Unmarshal([]byte(signed.FullSerialize()), &outer)
+	if err != nil {
+		return err
+	}
+	outer["resource"] = "key-change"
+	content, err := json.Marshal(outer)
+	if err != nil {
+		return err
+	}
+	_, err = c.post(c.keyChangeURL, c.key, content, nil)
+	if err != nil {
+		return err
+	}
+	c.key = newKey
+	return nil
+}
+
+// updateAccount makes the request of `updateRegistration` against an ACME v2
+// server, which takes the same fields without the resource
+func (c *AccountClient) updateAccount(uri string, payload map[string]interface{}) (AccountDetails, error) {
+	delete(payload, "resource")
+	c.v2.accountURL = uri
+	account, err := c.v2.UpdateAccount(payload)
+	if err != nil {
+		return AccountDetails{}, err
+	}
+	return AccountDetails{
+		Contact:   account.Contact,
+		Status:    account.Status,
+		CreatedAt: account.CreatedAt,
+		TosURL:    c.v2.directory.Meta.TermsOfService,
+	}, nil
+}
+
+func (c *AccountClient) post(url string, key crypto.PrivateKey, content []byte, result interface{}) (http.Header, error) {
+	signed, err := c.sign(key, content)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(signed.FullSerialize()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := acme.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error posting to %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.nonces = append(c.nonces, nonce)
+	}
+	if resp.StatusCode >= 400 {
+		remoteErr := acme.RemoteError{}
+		json.NewDecoder(resp.Body).Decode(&remoteErr)
+		remoteErr.StatusCode = resp.StatusCode
+		return resp.Header, remoteErr
+	}
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return resp.Header, fmt.Errorf("Error parsing response of %s: %s", url, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *AccountClient) sign(key crypto.PrivateKey, content []byte) (*jose.JsonWebSignature, error) {
+	var algorithm jose.SignatureAlgorithm
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		algorithm = jose.RS256
+	case *ecdsa.PrivateKey:
+		algorithm = jose.ES256
+		if key.Curve == elliptic.P384() {
+			algorithm = jose.ES384
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported account key of type %T", key)
+	}
+	signer, err := jose.NewSigner(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	signer.SetNonceSource(c)
+	return signer.Sign(content)
+}
+
+// Nonce implements `jose.NonceSource`
+func (c *AccountClient) Nonce() (string, error) {
+	if len(c.nonces) > 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		return nonce, nil
+	}
+	resp, err := acme.HTTPClient.Head(c.directoryURL)
+	if err != nil {
+		return "", fmt.Errorf("Error getting nonce: %s", err)
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("The ACME server didn't return a nonce")
+	}
+	return nonce, nil
+}
+
+func accountPublicKey(key crypto.PrivateKey) (crypto.PublicKey, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey, nil
+	}
+	return nil, fmt.Errorf("Unsupported account key of type %T (Expected RSA or ECDSA)", key)
+}
+
+// contactMatches returns whether the contact of the registration is the email
+func contactMatches(contact []string, email string) bool {
+	return len(contact) == 1 && contact[0] == "mailto:"+email
+}
+
+// updateContact sets the contact of the user's account to its email and
+// stores the updated registration
+func updateContact(user LegoUser) (LegoUser, error) {
+	log.Printf("Updating the contact of %s to %s", user.Registration.URI, user.Email)
+	client, err := newAccountClient(caServer(), user.key)
+	if err != nil {
+		return user, err
+	}
+	details, err := client.UpdateContact(user.Registration.URI, []string{"mailto:" + user.Email})
+	if err != nil {
+		return user, wrapError("Error updating the contact", err)
+	}
+	user.Registration.Body.Contact = details.Contact
+	return user, saveRegistration(user)
+}
+
+// runAccount implements the `account` subcommand, which manages the account
+// stored in the account secret
+func runAccount(args []string) error {
+	flags := flag.NewFlagSet("account", flag.ExitOnError)
+	email := flags.String("email", Getenv("EMAIL", ""), "New contact email for update-contact")
+	keyTypeName := flags.String("key-type", Getenv("ACCOUNT_KEY_TYPE", "rsa2048"), "Type of the new key for rotate-key: rsa2048, rsa4096, ec256 or ec384")
+	confirm := flags.Bool("yes", false, "Confirm deactivate, which can't be undone")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s account [flags] show|update-contact|deactivate|rotate-key\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("An account command is required")
+	}
+
+	user, err := getUserWithRegistration(*email)
+	if err != nil {
+		return err
+	}
+	client, err := newAccountClient(caServer(), user.key)
+	if err != nil {
+		return err
+	}
+	uri := user.Registration.URI
+	switch flags.Arg(0) {
+	case "show":
+		details, err := client.Fetch(uri)
+		if err != nil {
+			return err
+		}
+		printAccount(uri, details)
+		return nil
+	case "update-contact":
+		if *email == "" {
+			return errors.New("`--email` or `EMAIL` required")
+		}
+		_, err = updateContact(user)
+		return err
+	case "deactivate":
+		if !*confirm {
+			return errors.New("Deactivating an account can't be undone. Pass `--yes` to deactivate it.")
+		}
+		details, err := client.Deactivate(uri)
+		if err != nil {
+			return err
+		}
+		log.Printf("Account %s is %s. Clearing the account secret, the next run creates a new account.", uri, details.Status)
+		return getStateStore().ClearAccount()
+	case "rotate-key":
+		return rotateAccountKey(client, user, *keyTypeName)
+	}
+	flags.Usage()
+	return fmt.Errorf("Unknown account command %s", flags.Arg(0))
+}
+
+// rotateAccountKey rolls the account over to a new key and stores it. The new
+// key is stored as pending first, so it can be recovered if storing it as the
+// account key fails after the ACME server switched to it.
+func rotateAccountKey(client *AccountClient, user LegoUser, keyTypeName string) error {
+	keyType, ok := accountKeyTypes[keyTypeName]
+	if !ok {
+		return fmt.Errorf("Unknown account key type %s (Expected `rsa2048`, `rsa4096`, `ec256` or `ec384`)", keyTypeName)
+	}
+	pemKey, err := generateAccountKey(keyType)
+	if err != nil {
+		return err
+	}
+	newKey, err := parseAccountKey(pemKey)
+	if err != nil {
+		return err
+	}
+	store := getStateStore()
+	err = store.SavePendingAccountKey(pemKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rolling %s over to a new %s key", user.Registration.URI, keyTypeName)
+	err = client.ChangeKey(user.Registration.URI, newKey)
+	if err != nil {
+		return wrapError("Error changing the account key", err)
+	}
+	err = store.SaveAccountKey(pemKey)
+	if err != nil {
+		return fmt.Errorf("The account uses the new key but storing it failed. It's kept as `pending_private_key` in the account secret: %s", err)
+	}
+	publicKey, _ := accountPublicKey(newKey)
+	user.Registration.Body.Key = jose.JsonWebKey{Key: publicKey}
+	log.Printf("Account key rotated")
+	return saveRegistration(user)
+}
+
+func printAccount(uri string, details AccountDetails) {
+	fmt.Printf("URI:              %s\n", uri)
+	fmt.Printf("ID:               %d\n", details.ID)
+	fmt.Printf("Status:           %s\n", details.Status)
+	fmt.Printf("Contact:          %s\n", strings.Join(details.Contact, ", "))
+	fmt.Printf("Agreement:        %s\n", details.Agreement)
+	fmt.Printf("Terms of service: %s\n", details.TosURL)
+	if details.CreatedAt != "" {
+		fmt.Printf("Created at:       %s\n", details.CreatedAt)
+	}
+}
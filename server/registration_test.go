@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestAccountClient(t *testing.T) {
+	fake := newFakeACMEServer()
+	defer fake.server.Close()
+	fake.registered = true
+	privateKey, _ := generateAccountKey(acme.EC256)
+	key, _ := parseAccountKey(privateKey)
+	client, err := newAccountClient(fake.server.URL+"/directory", key)
+	if err != nil {
+		t.Fatalf("Error creating account client: %s", err)
+	}
+	uri := fake.server.URL + "/reg/1"
+
+	details, err := client.Fetch(uri)
+	if err != nil {
+		t.Fatalf("Error fetching account: %s", err)
+	}
+	if details.Status != "valid" || details.Contact[0] != "mailto:ops@example.com" || details.TosURL != fake.server.URL+"/terms" {
+		t.Fatalf("Unexpected account: %#v", details)
+	}
+
+	details, err = client.UpdateContact(uri, []string{"mailto:team@example.com"})
+	if err != nil || len(details.Contact) != 1 || details.Contact[0] != "mailto:team@example.com" {
+		t.Fatalf("Contact was not updated: %#v %v", details, err)
+	}
+
+	details, err = client.Deactivate(uri)
+	if err != nil || details.Status != "deactivated" {
+		t.Fatalf("Account was not deactivated: %#v %v", details, err)
+	}
+
+	_, err = client.Fetch(fake.server.URL + "/reg/2")
+	if remoteErr, ok := err.(acme.RemoteError); !ok || remoteErr.StatusCode != 404 {
+		t.Fatalf("Expected a remote error: %v", err)
+	}
+}
+
+func TestRotateAccountKey(t *testing.T) {
+	fake := newFakeACMEServer()
+	fake.registered = true
+	secrets := fakeAccountSecrets(t, fmt.Sprintf(`{"uri": "%s/reg/1"}`, fake.server.URL))
+	path := "/api/v1/namespaces/default/secrets/lets-encrypt-user"
+	oldKey := secrets.secrets[path].Data["private_key"]
+	withFakeACMEServer(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			user, err := getUserWithRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error getting user: %s", err)
+			}
+			client, err := newAccountClient(caServer(), user.key)
+			if err != nil {
+				t.Fatalf("Error creating account client: %s", err)
+			}
+			err = rotateAccountKey(client, user, "ec384")
+			if err != nil {
+				t.Fatalf("Error rotating key: %s", err)
+			}
+
+			secret := secrets.secrets[path]
+			if secret.Data["private_key"] == oldKey || secret.Data["pending_private_key"] != "" {
+				t.Fatalf("Expected the new key to be stored: %#v", secret.Data)
+			}
+			newKey, _ := base64.StdEncoding.DecodeString(secret.Data["private_key"])
+			keyType, err := privateKeyType(newKey)
+			if err != nil || keyType != acme.EC384 {
+				t.Fatalf("Expected an EC384 key: %s %v", keyType, err)
+			}
+
+			// The new key is used from now on
+			rotated, err := getUserWithRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error getting user: %s", err)
+			}
+			client, _ = newAccountClient(caServer(), rotated.key)
+			if _, err = client.Fetch(rotated.Registration.URI); err != nil {
+				t.Fatalf("Error fetching account with the new key: %s", err)
+			}
+		})
+	})
+	if len(fake.newKeys) != 1 || string(fake.newKeys[0]) != string(fake.key) {
+		t.Fatalf("Expected the account to be rolled over to the new key: %s", fake.newKeys)
+	}
+}
+
+func TestEnsureRegistrationUpdatesContact(t *testing.T) {
+	fake := newFakeACMEServer()
+	fake.registered = true
+	secrets := fakeAccountSecrets(t, fmt.Sprintf(`{"uri": "%s/reg/1"}`, fake.server.URL))
+	withFakeACMEServer(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			user, err := ensureRegistration("team@example.com")
+			if err != nil {
+				t.Fatalf("Error ensuring registration: %s", err)
+			}
+			if user.Registration.Body.Contact[0] != "mailto:team@example.com" {
+				t.Fatalf("Expected the new contact: %v", user.Registration.Body.Contact)
+			}
+			stored, err := getStateStore().LoadRegistration()
+			if err != nil || stored.Body.Contact[0] != "mailto:team@example.com" {
+				t.Fatalf("Expected the new contact to be stored: %v", err)
+			}
+		})
+	})
+	if fake.contact[0] != "mailto:team@example.com" || fake.count("POST /new-reg") != 0 {
+		t.Fatalf("Expected the contact of the existing account to be updated: %v %v", fake.contact, fake.requests)
+	}
+}
+
+func TestRunAccountWithoutAccount(t *testing.T) {
+	fake := newFakeACMEServer()
+	withoutKey := fakeAccountSecrets(t, fmt.Sprintf(`{"uri": "%s/reg/1"}`, fake.server.URL))
+	delete(withoutKey.secrets["/api/v1/namespaces/default/secrets/lets-encrypt-user"].Data, "private_key")
+	for name, secrets := range map[string]*fakeSecretsServer{
+		"no account secret": {secrets: map[string]Secret{}},
+		"no account key":    withoutKey,
+	} {
+		withFakeACMEServer(t, fake, func() {
+			withFakeSecretsServer(t, secrets, func() {
+				for _, args := range [][]string{{"show"}, {"--yes", "deactivate"}} {
+					if err := runAccount(args); err == nil {
+						t.Errorf("%s: Expected `account %s` to fail", name, args)
+					}
+				}
+			})
+		})
+		if secret, ok := secrets.secrets["/api/v1/namespaces/default/secrets/lets-encrypt-user"]; ok && secret.Data["private_key"] != "" {
+			t.Errorf("%s: Expected no account key to be created", name)
+		}
+	}
+	if len(fake.requests) != 0 {
+		t.Fatalf("Expected no requests to the ACME server: %v", fake.requests)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// RenderOptions are the settings the Kubernetes resources are rendered with
+type RenderOptions struct {
+	Domains        []string
+	Email          string
+	Namespace      string
+	Image          string
+	Tag            string
+	SecretName     string
+	UserSecretName string
+	DNSProvider    string
+	KeyType        string
+	AccountKeyPath string
+	AccountKeyType string
+	OutputDir      string
+}
+
+// stringsFlag is a flag that can be repeated and/or take comma separated values
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*f = append(*f, item)
+		}
+	}
+	return nil
+}
+
+// runRender implements the `render` subcommand, which writes the Secret,
+// Service and Job needed to issue a certificate with the Job mode
+func runRender(args []string) error {
+	options := RenderOptions{}
+	domains := stringsFlag{}
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	flags.Var(&domains, "domain", "Domain of the certificate. Can be repeated or comma separated")
+	flags.StringVar(&options.Email, "email", "", "Email of the Let's Encrypt account")
+	flags.StringVar(&options.Namespace, "namespace", "", "Namespace of the resources. Defaults to the namespace they are applied to")
+	flags.StringVar(&options.Image, "image", "quay.io/hiphipjorge/auto-kubernetes-lets-encrypt", "Image of the Job")
+	flags.StringVar(&options.Tag, "tag", "44122121c72ea670758360fcf7bb4bbbbaef2bb4", "Tag of the image")
+	flags.StringVar(&options.SecretName, "secret-name", "auto-kubernetes-lets-encrypt", "Secret the certificate is written to")
+	flags.StringVar(&options.UserSecretName, "user-secret-name", "auto-kubernetes-lets-encrypt", "Secret holding the Let's Encrypt account")
+	flags.StringVar(&options.DNSProvider, "dns-provider", "", "Lego DNS provider. Uses the DNS-01 challenge instead of HTTP-01 and leaves out the Service")
+	flags.StringVar(&options.KeyType, "key-type", "", "Key type of the certificate: rsa2048, rsa4096, rsa8192, ec256 or ec384")
+	flags.StringVar(&options.AccountKeyPath, "account-key", "private-key.pem", "Account key. Generated if it doesn't exist yet, an existing key is never overwritten")
+	flags.StringVar(&options.AccountKeyType, "account-key-type", "rsa2048", "Type of a generated account key: rsa2048, rsa4096, ec256 or ec384")
+	flags.StringVar(&options.OutputDir, "out", ".", "Directory the resources are written to")
+	flags.Parse(args)
+	options.Domains = domains
+	return renderResources(options)
+}
+
+func renderResources(options RenderOptions) error {
+	if len(options.Domains) == 0 {
+		return errors.New("At least one `--domain` is required")
+	}
+	if options.Email == "" {
+		return errors.New("`--email` is required")
+	}
+	if options.KeyType != "" {
+		if _, err := parseCertificateKeyType(options.KeyType); err != nil {
+			return err
+		}
+	}
+	privateKey, err := loadOrGenerateAccountKey(options.AccountKeyPath, options.AccountKeyType)
+	if err != nil {
+		return err
+	}
+	challengeType := HTTP_01_CHALLENGE
+	if options.DNSProvider != "" {
+		challengeType = DNS_01_CHALLENGE
+	}
+	data := struct {
+		RenderOptions
+		ChallengeType    string
+		PrivateKeyBase64 string
+	}{options, challengeType, base64.StdEncoding.EncodeToString(privateKey)}
+
+	files := []struct {
+		name     string
+		template *template.Template
+	}{
+		{"kubernetes-resources-part-1.yml", RESOURCES_PART_1_TEMPLATE},
+		{"kubernetes-resources-part-2.yml", RESOURCES_PART_2_TEMPLATE},
+	}
+	for _, file := range files {
+		path := filepath.Join(options.OutputDir, file.name)
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		err = file.template.Execute(out, data)
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("Error rendering %s: %s", path, err)
+		}
+		log.Printf("Wrote %s", path)
+	}
+	return nil
+}
+
+// loadOrGenerateAccountKey returns the PEM encoded account key at the path,
+// generating it if it doesn't exist yet
+func loadOrGenerateAccountKey(path string, keyTypeName string) ([]byte, error) {
+	existing, err := ioutil.ReadFile(path)
+	if err == nil {
+		log.Printf("Using existing account key %s", path)
+		if _, err := parseAccountKey(existing); err != nil {
+			return nil, fmt.Errorf("Invalid account key %s: %s", path, err)
+		}
+		return existing, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	keyType, ok := accountKeyTypes[keyTypeName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown account key type %s", keyTypeName)
+	}
+	log.Printf("Generating %s account key %s", keyTypeName, path)
+	pemKey, err := generateAccountKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	// O_EXCL so a key created in the meantime is never overwritten
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Refusing to overwrite account key %s: %s", path, err)
+	}
+	defer out.Close()
+	_, err = out.Write(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	return pemKey, nil
+}
+
+// yamlQuote quotes a string for YAML. JSON strings are valid YAML scalars.
+func yamlQuote(value string) string {
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+var renderFuncs = template.FuncMap{
+	"quote": yamlQuote,
+	"join":  strings.Join,
+}
+
+var RESOURCES_PART_1_TEMPLATE = template.Must(template.New("part-1").Funcs(renderFuncs).Parse(`apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ quote .UserSecretName }}
+{{- if .Namespace }}
+  namespace: {{ quote .Namespace }}
+{{- end }}
+type: Opaque
+data:
+  private_key: {{ quote .PrivateKeyBase64 }}
+  registration: ""
+{{- if eq .ChallengeType "http-01" }}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: auto-kubernetes-lets-encrypt
+{{- if .Namespace }}
+  namespace: {{ quote .Namespace }}
+{{- end }}
+spec:
+  selector:
+    app: auto-kubernetes-lets-encrypt
+  type: LoadBalancer
+  ports:
+  - protocol: "TCP"
+    port: 80
+{{- end }}
+`))
+
+var RESOURCES_PART_2_TEMPLATE = template.Must(template.New("part-2").Funcs(renderFuncs).Parse(`apiVersion: batch/v1
+kind: Job
+metadata:
+  name: auto-kubernetes-lets-encrypt
+{{- if .Namespace }}
+  namespace: {{ quote .Namespace }}
+{{- end }}
+  labels:
+    app: auto-kubernetes-lets-encrypt
+spec:
+  template:
+    metadata:
+      name: auto-kubernetes-lets-encrypt
+      labels:
+        app: auto-kubernetes-lets-encrypt
+    spec:
+      containers:
+      - image: {{ quote (printf "%s:%s" .Image .Tag) }}
+        name: auto-kubernetes-lets-encrypt
+        imagePullPolicy: Always
+        livenessProbe:
+          httpGet:
+            path: /health
+            port: 80
+        readinessProbe:
+          httpGet:
+            path: /health
+            port: 80
+        ports:
+        - name: main
+          containerPort: 80
+        env:
+        - name: DOMAINS
+          value: {{ quote (join .Domains ",") }}
+        - name: EMAIL
+          value: {{ quote .Email }}
+        - name: SECRET_NAME
+          value: {{ quote .SecretName }}
+        - name: LETS_ENCRYPT_USER_SECRET_NAME
+          value: {{ quote .UserSecretName }}
+        - name: CHALLENGE_TYPE
+          value: {{ quote .ChallengeType }}
+        - name: DNS_PROVIDER
+          value: {{ quote .DNSProvider }}
+{{- if .KeyType }}
+        - name: KEY_TYPE
+          value: {{ quote .KeyType }}
+{{- end }}
+      restartPolicy: Never
+`))
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRenderResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	options := RenderOptions{
+		Domains:        []string{"example.com", "www.example.com"},
+		Email:          `ops: "certs" #1@example.com`,
+		Namespace:      "certs",
+		Image:          "example/auto-kubernetes-lets-encrypt",
+		Tag:            "v1",
+		SecretName:     "example-tls",
+		UserSecretName: "lets-encrypt-user",
+		KeyType:        "ec256",
+		AccountKeyPath: filepath.Join(dir, "private-key.pem"),
+		AccountKeyType: "rsa2048",
+		OutputDir:      dir,
+	}
+	err = renderResources(options)
+	if err != nil {
+		t.Fatalf("Error rendering resources: %s", err)
+	}
+	accountKey, err := ioutil.ReadFile(options.AccountKeyPath)
+	if err != nil {
+		t.Fatalf("Account key was not generated: %s", err)
+	}
+
+	part1, _ := ioutil.ReadFile(filepath.Join(dir, "kubernetes-resources-part-1.yml"))
+	documents := strings.Split(string(part1), "\n---\n")
+	if len(documents) != 2 {
+		t.Fatalf("Expected a Secret and a Service: %s", part1)
+	}
+	secret := Secret{}
+	err = yaml.Unmarshal([]byte(documents[0]), &secret)
+	if err != nil {
+		t.Fatalf("Error parsing secret: %s", err)
+	}
+	privateKey, _ := base64.StdEncoding.DecodeString(secret.Data["private_key"])
+	if string(privateKey) != string(accountKey) || secret.Metadata.Namespace != "certs" {
+		t.Fatalf("Unexpected secret: %s", documents[0])
+	}
+
+	part2, _ := ioutil.ReadFile(filepath.Join(dir, "kubernetes-resources-part-2.yml"))
+	job := struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Containers []struct {
+						Image string
+						Env   []struct {
+							Name  string
+							Value string
+						}
+					}
+				}
+			}
+		}
+	}{}
+	err = yaml.Unmarshal(part2, &job)
+	if err != nil {
+		t.Fatalf("Error parsing job: %s", err)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if container.Image != "example/auto-kubernetes-lets-encrypt:v1" {
+		t.Fatalf("Unexpected image: %s", container.Image)
+	}
+	env := make(map[string]string)
+	for _, variable := range container.Env {
+		env[variable.Name] = variable.Value
+	}
+	if env["EMAIL"] != options.Email || env["DOMAINS"] != "example.com,www.example.com" || env["SECRET_NAME"] != "example-tls" || env["KEY_TYPE"] != "ec256" {
+		t.Fatalf("Unexpected environment: %v", env)
+	}
+	// The account is read from the secret through the API
+	if strings.Contains(string(part2), "secretKeyRef") {
+		t.Fatalf("Expected no environment from secrets:\n%s", part2)
+	}
+
+	// The DNS-01 challenge doesn't need the Service and the key is kept
+	options.DNSProvider = "cloudflare"
+	err = renderResources(options)
+	if err != nil {
+		t.Fatalf("Error rendering resources: %s", err)
+	}
+	part1, _ = ioutil.ReadFile(filepath.Join(dir, "kubernetes-resources-part-1.yml"))
+	if strings.Contains(string(part1), "kind: Service") {
+		t.Fatalf("Expected no Service for the DNS-01 challenge: %s", part1)
+	}
+	sameKey, _ := ioutil.ReadFile(options.AccountKeyPath)
+	if string(sameKey) != string(accountKey) {
+		t.Fatalf("Existing account key was overwritten")
+	}
+}
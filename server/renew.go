@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Renew certificates once they are within this window of their NotAfter date
+var RENEW_BEFORE = 30 * 24 * time.Hour
+
+// How often the controller checks whether the certificate needs to be renewed
+var RENEW_CHECK_INTERVAL = 12 * time.Hour
+
+// loadRenewalSettings reads `RENEW_BEFORE` and `RENEW_CHECK_INTERVAL`
+func loadRenewalSettings() error {
+	renewBefore, err := time.ParseDuration(Getenv("RENEW_BEFORE", RENEW_BEFORE.String()))
+	if err != nil {
+		return fmt.Errorf("Invalid `RENEW_BEFORE` duration: %s", err)
+	}
+	RENEW_BEFORE = renewBefore
+	checkInterval, err := time.ParseDuration(Getenv("RENEW_CHECK_INTERVAL", RENEW_CHECK_INTERVAL.String()))
+	if err != nil {
+		return fmt.Errorf("Invalid `RENEW_CHECK_INTERVAL` duration: %s", err)
+	}
+	RENEW_CHECK_INTERVAL = checkInterval
+	return nil
+}
+
+func runController() error {
+	err := loadRenewalSettings()
+	if err != nil {
+		return err
+	}
+	targets, err := envCertificateTargets()
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting renewal controller (Renew before: %s, Check interval: %s)", RENEW_BEFORE, RENEW_CHECK_INTERVAL)
+	for {
+		log.Printf("Checking certificates for renewal")
+		err := renew(targets)
+		if err != nil {
+			log.Printf("Error renewing certs: %s", err)
+		}
+		time.Sleep(RENEW_CHECK_INTERVAL)
+	}
+}
+
+const (
+	OBTAIN_CERTIFICATE = "obtain"
+	RENEW_CERTIFICATE  = "renew"
+)
+
+// inspectCertificate reads the certificate stored in the target secret and
+// returns what needs to be done with it: nothing, renew it once it falls
+// within the renewal window, or obtain a new one if the secret holds no usable
+// certificate. A partially issued certificate only needs to cover the domains
+// that weren't excluded, which are attempted again once it's due for renewal.
+func inspectCertificate(target CertificateTarget) (acme.CertificateResource, string) {
+	var excluded map[string]string
+	if allowPartial(target) {
+		var err error
+		excluded, err = loadExcludedDomains(target)
+		if err != nil {
+			log.Printf("Error reading the excluded domains (%s)", err)
+		}
+		target = issuedTarget(target, excluded)
+	}
+	certificates, err := getStateStore().LoadCertificate(target)
+	if err != nil {
+		log.Printf("No usable certificate found in secret `%s` (%s)", target.SecretName, err)
+		return certificates, OBTAIN_CERTIFICATE
+	}
+	notAfter, err := acme.GetPEMCertExpiration(certificates.Certificate)
+	if err != nil {
+		log.Printf("Error reading certificate expiration (%s)", err)
+		return certificates, OBTAIN_CERTIFICATE
+	}
+	if !certificateCoversDomains(certificates.Certificate, target.Domains) {
+		log.Printf("Certificate in secret `%s` does not cover %s", target.SecretName, target.Domains)
+		return certificates, OBTAIN_CERTIFICATE
+	}
+	if target.CSR != nil {
+		csr, err := loadCSR(target)
+		if err != nil || !certificateMatchesCSR(certificates.Certificate, csr) {
+			log.Printf("Certificate in secret `%s` was not issued for the CSR in %s", target.SecretName, target.CSR)
+			return certificates, OBTAIN_CERTIFICATE
+		}
+	}
+	renewBefore := target.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = RENEW_BEFORE
+	}
+	if notAfter.Sub(time.Now()) > renewBefore {
+		log.Printf("Certificate for %s expires on %s. No renewal needed.", certificates.Domain, notAfter)
+		return certificates, ""
+	}
+	log.Printf("Certificate for %s expires on %s", certificates.Domain, notAfter)
+	if len(excluded) > 0 {
+		log.Printf("Obtaining a new certificate to attempt the excluded domains again")
+		return certificates, OBTAIN_CERTIFICATE
+	}
+	return certificates, RENEW_CERTIFICATE
+}
+
+// ensureCertificate makes sure the target secret holds a valid certificate
+// for the target domains and returns it
+func ensureCertificate(target CertificateTarget, email string) (acme.CertificateResource, error) {
+	certificates, action := inspectCertificate(target)
+	return issueCertificate(target, email, certificates, action)
+}
+
+// issueCertificate carries out the action returned by `inspectCertificate`
+func issueCertificate(target CertificateTarget, email string, certificates acme.CertificateResource, action string) (acme.CertificateResource, error) {
+	switch action {
+	case OBTAIN_CERTIFICATE:
+		log.Printf("Obtaining a new certificate for %s", target.Domains)
+		return obtainCertificate(target, email)
+	case RENEW_CERTIFICATE:
+		if target.CSR != nil {
+			// The CSR may have changed since, so it's read again
+			log.Printf("Obtaining a new certificate for the CSR in %s", target.CSR)
+			return obtainCertificateForCSR(target, email)
+		}
+		log.Printf("Renewing certificate for %s", target.Domains)
+		return renewCertificate(target, email, certificates)
+	}
+	return certificates, nil
+}
+
+func renewCertificate(target CertificateTarget, email string, certificates acme.CertificateResource) (acme.CertificateResource, error) {
+	err := prepareSecret(target)
+	if err != nil {
+		return certificates, err
+	}
+	// The existing key is passed on to the renewal, which reuses it
+	keyType, certificates, err := reusableKey(target, certificates)
+	if err != nil {
+		return certificates, err
+	}
+	target.KeyType = keyType
+	legoUser, err := getUserWithRegistration(email)
+	if err != nil {
+		log.Printf("Error getting user with registration: %s", err)
+		return certificates, err
+	}
+	client, err := newAcmeClient(legoUser, target)
+	if err != nil {
+		return certificates, err
+	}
+	bundle := false
+	renewed, err := renewWithClient(client, certificates, bundle)
+	if err != nil {
+		log.Printf("Error renewing certificate: %s", err)
+		return certificates, err
+	}
+	return renewed, saveCertificates(target, renewed)
+}
+
+// renewWithClient obtains a new certificate for the domains of the
+// certificate, reusing its private key or CSR. Unlike `RenewCertificate` of
+// lego, which only returns the error of the first domain, it fails if any
+// domain fails, so a partial result never replaces the stored certificate.
+func renewWithClient(client ACMEClient, certificates acme.CertificateResource, bundle bool) (acme.CertificateResource, error) {
+	var renewed acme.CertificateResource
+	var failures map[string]error
+	if len(certificates.CSR) > 0 {
+		csr, err := parseCSR(certificates.CSR)
+		if err != nil {
+			return certificates, err
+		}
+		renewed, failures = client.ObtainCertificateForCSR(*csr, bundle)
+	} else {
+		cert, err := parseCertificate(certificates.Certificate)
+		if err != nil {
+			return certificates, err
+		}
+		var privKey crypto.PrivateKey
+		if certificates.PrivateKey != nil {
+			privKey, err = parseAccountKey(certificates.PrivateKey)
+			if err != nil {
+				return certificates, err
+			}
+		}
+		renewed, failures = client.ObtainCertificate(certificateDomains(cert), bundle, privKey, false)
+	}
+	if len(failures) > 0 {
+		return certificates, ObtainError{Failures: failures}
+	}
+	return renewed, nil
+}
+
+func certificateCoversDomains(certificate []byte, domains []string) bool {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return false
+	}
+	for _, domain := range domains {
+		if cert.VerifyHostname(domain) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestInspectCertificate(t *testing.T) {
+	day := 24 * time.Hour
+	for _, test := range []struct {
+		name        string
+		domains     []string
+		renewBefore time.Duration
+		// Domains and expiration of the stored certificate, none if empty
+		certDomains []string
+		expiresIn   time.Duration
+		certificate []byte
+		action      string
+	}{
+		{name: "missing secret", domains: []string{"example.com"}, action: OBTAIN_CERTIFICATE},
+		{name: "unparsable certificate", domains: []string{"example.com"}, certificate: []byte("not a certificate"), action: OBTAIN_CERTIFICATE},
+		{name: "outside renewal window", domains: []string{"example.com"}, certDomains: []string{"example.com"}, expiresIn: 60 * day, action: ""},
+		{name: "inside renewal window", domains: []string{"example.com"}, certDomains: []string{"example.com"}, expiresIn: 10 * day, action: RENEW_CERTIFICATE},
+		{name: "renew before of the target", domains: []string{"example.com"}, renewBefore: 90 * day, certDomains: []string{"example.com"}, expiresIn: 60 * day, action: RENEW_CERTIFICATE},
+		{name: "expired", domains: []string{"example.com"}, certDomains: []string{"example.com"}, expiresIn: -day, action: RENEW_CERTIFICATE},
+		{name: "missing domain", domains: []string{"example.com", "www.example.com"}, certDomains: []string{"example.com"}, expiresIn: 60 * day, action: OBTAIN_CERTIFICATE},
+		{name: "wildcard covers subdomain", domains: []string{"www.example.com", "api.example.com"}, certDomains: []string{"*.example.com"}, expiresIn: 60 * day, action: ""},
+		{name: "wildcard doesn't cover apex", domains: []string{"example.com"}, certDomains: []string{"*.example.com"}, expiresIn: 60 * day, action: OBTAIN_CERTIFICATE},
+	} {
+		fake := &fakeSecretsServer{secrets: map[string]Secret{}}
+		certificate, key := test.certificate, []byte(nil)
+		if test.certDomains != nil {
+			certificate, key = selfSignedCertificate(t, test.certDomains, time.Now().Add(test.expiresIn))
+		}
+		if certificate != nil {
+			fake.secrets["/api/v1/namespaces/default/secrets/example-tls"] = Secret{
+				Metadata: ObjectMeta{Name: "example-tls", Namespace: "default"},
+				Type:     SECRET_TYPE_TLS,
+				Data:     encodeSecretData(map[string][]byte{"tls.crt": certificate, "tls.key": key}),
+			}
+		}
+		target := CertificateTarget{Namespace: "default", SecretName: "example-tls", Domains: test.domains, Layout: SECRET_LAYOUT_TLS, RenewBefore: test.renewBefore}
+		withFakeSecretsServer(t, fake, func() {
+			certificates, action := inspectCertificate(target)
+			if action != test.action {
+				t.Errorf("%s: Expected action %q: %q", test.name, test.action, action)
+			}
+			if action == "" {
+				// The stored certificate is returned without contacting the ACME server
+				ensured, err := ensureCertificate(target, "ops@example.com")
+				if err != nil || string(ensured.Certificate) != string(certificate) || string(certificates.Certificate) != string(certificate) {
+					t.Errorf("%s: Expected the stored certificate: %v", test.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCertificateCoversDomains(t *testing.T) {
+	certificate, _ := selfSignedCertificate(t, []string{"example.com", "*.example.com"}, time.Now().Add(time.Hour))
+	if !certificateCoversDomains(certificate, []string{"example.com", "www.example.com"}) {
+		t.Errorf("Expected the certificate to cover the apex and the subdomain")
+	}
+	for _, domains := range [][]string{{"example.org"}, {"a.b.example.com"}} {
+		if certificateCoversDomains(certificate, domains) {
+			t.Errorf("Expected the certificate not to cover %s", domains)
+		}
+	}
+	if certificateCoversDomains([]byte("not a certificate"), []string{"example.com"}) {
+		t.Errorf("Expected an unparsable certificate not to cover any domain")
+	}
+}
+
+// failingACMEClient fails to validate some of the domains, returning an empty
+// certificate like lego does
+type failingACMEClient struct {
+	failures map[string]error
+	domains  []string
+	privKey  crypto.PrivateKey
+}
+
+func (c *failingACMEClient) SetChallengeProvider(challenge acme.Challenge, p acme.ChallengeProvider) error {
+	return nil
+}
+
+func (c *failingACMEClient) ExcludeChallenges(challenges []acme.Challenge) {}
+
+func (c *failingACMEClient) AgreeToTOS() error {
+	return nil
+}
+
+func (c *failingACMEClient) ObtainCertificate(domains []string, bundle bool, privKey crypto.PrivateKey, mustStaple bool) (acme.CertificateResource, map[string]error) {
+	c.domains, c.privKey = domains, privKey
+	return acme.CertificateResource{}, c.failures
+}
+
+func (c *failingACMEClient) ObtainCertificateForCSR(csr x509.CertificateRequest, bundle bool) (acme.CertificateResource, map[string]error) {
+	c.domains = csrDomains(&csr)
+	return acme.CertificateResource{}, c.failures
+}
+
+func (c *failingACMEClient) RevokeCertificate(certificate []byte) error {
+	return nil
+}
+
+func TestRenewWithClientFailsOnAnyDomain(t *testing.T) {
+	certificate, key := selfSignedCertificate(t, []string{"example.com", "www.example.com"}, time.Now().Add(time.Hour))
+	certificates := acme.CertificateResource{Domain: "example.com", Certificate: certificate, PrivateKey: key}
+	// Only the second domain fails, which `RenewCertificate` of lego ignores
+	client := &failingACMEClient{failures: map[string]error{"www.example.com": errors.New("Invalid response")}}
+	renewed, err := renewWithClient(client, certificates, false)
+	if _, ok := err.(ObtainError); !ok {
+		t.Fatalf("Expected the failure of the second domain: %v", err)
+	}
+	if string(renewed.Certificate) != string(certificate) {
+		t.Fatalf("Expected the stored certificate to be returned")
+	}
+	if len(client.domains) != 2 || client.domains[0] != "example.com" || client.domains[1] != "www.example.com" {
+		t.Fatalf("Unexpected domains: %v", client.domains)
+	}
+	if _, ok := client.privKey.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("Expected the key to be reused: %T", client.privKey)
+	}
+
+	// Certificates issued for a CSR are renewed with the CSR
+	csrKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"example.com", "www.example.com"}}, csrKey)
+	if err != nil {
+		t.Fatalf("Error creating CSR: %s", err)
+	}
+	certificates = acme.CertificateResource{Domain: "example.com", Certificate: certificate, CSR: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})}
+	client = &failingACMEClient{failures: map[string]error{"www.example.com": errors.New("Invalid response")}}
+	renewed, err = renewWithClient(client, certificates, false)
+	if _, ok := err.(ObtainError); !ok || string(renewed.Certificate) != string(certificate) || len(client.domains) != 2 {
+		t.Fatalf("Expected the failure of the second domain of the CSR: %v %v", client.domains, err)
+	}
+}
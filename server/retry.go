@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Defaults of retrying certificates that couldn't be issued
+var RETRY_ATTEMPTS = 10
+var RETRY_INITIAL_DELAY = 5 * time.Second
+var RETRY_MAX_DELAY = 5 * time.Minute
+
+// Exit codes of a run that couldn't issue all certificates. Any other error
+// exits with 1.
+const (
+	EXIT_PERMANENT_ERROR = 3
+	EXIT_RATE_LIMITED    = 4
+)
+
+// Classes of errors returned while issuing certificates
+const (
+	ERROR_RETRYABLE    = "retryable"
+	ERROR_RATE_LIMITED = "rate limited"
+	ERROR_PERMANENT    = "permanent"
+)
+
+// ACME problem types (without the `urn:acme:error:` or
+// `urn:ietf:params:acme:error:` prefix) of errors that may go away on their
+// own, like a DNS record that hasn't propagated yet
+var RETRYABLE_ACME_ERRORS = []string{"serverInternal", "badNonce", "dns", "connection", "unknownHost"}
+
+// WrappedError adds what was being done to an error, keeping the error so it
+// can still be classified
+type WrappedError struct {
+	Message string
+	Err     error
+}
+
+func (e WrappedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+func wrapError(message string, err error) error {
+	return WrappedError{Message: message, Err: err}
+}
+
+// ConfigError is an invalid setting or spec, like an unknown `KEY_TYPE` or
+// secret layout. It fails the same way until the configuration is fixed.
+type ConfigError struct {
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return e.Message
+}
+
+func configError(format string, args ...interface{}) error {
+	return ConfigError{Message: fmt.Sprintf(format, args...)}
+}
+
+// unwrapError returns the error wrapped by `WrappedError`s
+func unwrapError(err error) error {
+	for {
+		wrapped, ok := err.(WrappedError)
+		if !ok {
+			return err
+		}
+		err = wrapped.Err
+	}
+}
+
+// remoteError returns the ACME error the error is, wraps or embeds, like
+// `acme.TOSError` or the challenge errors of lego
+func remoteError(err error) (acme.RemoteError, bool) {
+	err = unwrapError(err)
+	if remoteErr, ok := err.(acme.RemoteError); ok {
+		return remoteErr, true
+	}
+	value := reflect.ValueOf(err)
+	if value.Kind() != reflect.Struct {
+		return acme.RemoteError{}, false
+	}
+	field := value.FieldByName("RemoteError")
+	if !field.IsValid() {
+		return acme.RemoteError{}, false
+	}
+	remoteErr, ok := field.Interface().(acme.RemoteError)
+	return remoteErr, ok
+}
+
+// acmeErrorType returns the problem type without its namespace
+func acmeErrorType(remoteErr acme.RemoteError) string {
+	return remoteErr.Type[strings.LastIndex(remoteErr.Type, ":")+1:]
+}
+
+func rateLimited(remoteErr acme.RemoteError) bool {
+	return remoteErr.StatusCode == http.StatusTooManyRequests || acmeErrorType(remoteErr) == "rateLimited"
+}
+
+func serverError(remoteErr acme.RemoteError) bool {
+	return remoteErr.StatusCode >= 500 || acmeErrorType(remoteErr) == "serverInternal"
+}
+
+// classifyError returns whether issuing the certificate again may succeed
+// (`ERROR_RETRYABLE`), should wait for a rate limit (`ERROR_RATE_LIMITED`) or
+// will fail the same way (`ERROR_PERMANENT`). ACME errors are permanent unless
+// the ACME server failed or the problem is in `RETRYABLE_ACME_ERRORS`. Errors
+// in the configuration (`ConfigError`) are permanent. Other errors that don't
+// come from the ACME server, like Kubernetes API errors, are retryable. A `WrappedError` is classified by the error it wraps.
+func classifyError(err error) string {
+	switch err := unwrapError(err).(type) {
+	case CAUnavailableError:
+		return ERROR_RETRYABLE
+	case ConfigError:
+		return ERROR_PERMANENT
+	case acme.TOSError:
+		return ERROR_PERMANENT
+	case ObtainError:
+		// Each domain is attempted again as long as one of them may succeed
+		class := ERROR_PERMANENT
+		for _, failure := range err.Failures {
+			switch classifyError(failure) {
+			case ERROR_RATE_LIMITED:
+				return ERROR_RATE_LIMITED
+			case ERROR_RETRYABLE:
+				class = ERROR_RETRYABLE
+			}
+		}
+		return class
+	}
+	remoteErr, ok := remoteError(err)
+	if !ok {
+		return ERROR_RETRYABLE
+	}
+	if rateLimited(remoteErr) {
+		return ERROR_RATE_LIMITED
+	}
+	if serverError(remoteErr) {
+		return ERROR_RETRYABLE
+	}
+	errorType := acmeErrorType(remoteErr)
+	for _, retryable := range RETRYABLE_ACME_ERRORS {
+		if errorType == retryable {
+			return ERROR_RETRYABLE
+		}
+	}
+	return ERROR_PERMANENT
+}
+
+// exitCode returns the exit code of a run that failed with the error. A
+// permanent error of any certificate takes precedence over rate limits.
+func exitCode(err error) int {
+	errs := []error{err}
+	if issueErr, ok := err.(IssueError); ok {
+		errs = issueErr.Errors
+	}
+	code := 1
+	for _, err := range errs {
+		switch classifyError(err) {
+		case ERROR_PERMANENT:
+			return EXIT_PERMANENT_ERROR
+		case ERROR_RATE_LIMITED:
+			code = EXIT_RATE_LIMITED
+		}
+	}
+	return code
+}
+
+// RetryPolicy is how often and how long to wait before issuing certificates
+// again
+type RetryPolicy struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+func envRetryPolicy() (RetryPolicy, error) {
+	policy := RetryPolicy{Attempts: RETRY_ATTEMPTS, InitialDelay: RETRY_INITIAL_DELAY, MaxDelay: RETRY_MAX_DELAY}
+	var err error
+	policy.Attempts, err = strconv.Atoi(Getenv("RETRY_ATTEMPTS", strconv.Itoa(RETRY_ATTEMPTS)))
+	if err != nil || policy.Attempts < 1 {
+		return policy, fmt.Errorf("Invalid `RETRY_ATTEMPTS` (Expected a positive number)")
+	}
+	policy.InitialDelay, err = time.ParseDuration(Getenv("RETRY_INITIAL_DELAY", RETRY_INITIAL_DELAY.String()))
+	if err != nil {
+		return policy, fmt.Errorf("Invalid `RETRY_INITIAL_DELAY`: %s", err)
+	}
+	policy.MaxDelay, err = time.ParseDuration(Getenv("RETRY_MAX_DELAY", RETRY_MAX_DELAY.String()))
+	if err != nil {
+		return policy, fmt.Errorf("Invalid `RETRY_MAX_DELAY`: %s", err)
+	}
+	return policy, nil
+}
+
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoff returns the delay before the retry, doubling from the initial delay
+// up to the maximum. A random half of it is left out, so servers that failed
+// at the same time don't retry at the same time.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// generateWithRetry issues the certificates of the targets, issuing the ones
+// that failed again after a backoff. Certificates that failed with a permanent
+// error aren't attempted again. When rate limited it waits as long as the ACME
+// server asked with `Retry-After`, unless that's longer than the maximum
+// delay.
+func generateWithRetry(targets []CertificateTarget, generate func(targets []CertificateTarget) error) error {
+	policy, err := envRetryPolicy()
+	if err != nil {
+		return err
+	}
+	// Give the challenge server time to start
+	time.Sleep(policy.InitialDelay)
+	failed := IssueError{}
+	for attempt := 1; ; attempt++ {
+		log.Printf("Attempt %d of %d to generate certs", attempt, policy.Attempts)
+		ACME_RETRY_AFTER.Reset()
+		err = generate(targets)
+		if err == nil {
+			break
+		}
+		log.Printf("Error generating certs: %s", err)
+		issueErr, ok := err.(IssueError)
+		if !ok {
+			issueErr = IssueError{Failed: targets}
+			for range targets {
+				issueErr.Errors = append(issueErr.Errors, err)
+			}
+		}
+		retry := IssueError{}
+		rateLimit := false
+		for i, target := range issueErr.Failed {
+			failure := issueErr.Errors[i]
+			switch classifyError(failure) {
+			case ERROR_PERMANENT:
+				log.Printf("Not retrying %s in secret `%s` after a permanent error", target.Domains, target.SecretName)
+				failed.Failed = append(failed.Failed, target)
+				failed.Errors = append(failed.Errors, failure)
+				continue
+			case ERROR_RATE_LIMITED:
+				rateLimit = true
+			}
+			retry.Failed = append(retry.Failed, target)
+			retry.Errors = append(retry.Errors, failure)
+		}
+		if len(retry.Failed) == 0 {
+			break
+		}
+		if attempt == policy.Attempts {
+			log.Printf("Exiting after attempting to generate certs %d times", attempt)
+			failed.Failed = append(failed.Failed, retry.Failed...)
+			failed.Errors = append(failed.Errors, retry.Errors...)
+			break
+		}
+		delay := policy.backoff(attempt)
+		if retryAfter := ACME_RETRY_AFTER.Delay(); rateLimit && retryAfter > delay {
+			if retryAfter > policy.MaxDelay {
+				log.Printf("Rate limited for %s. Not waiting longer than %s", retryAfter, policy.MaxDelay)
+				failed.Failed = append(failed.Failed, retry.Failed...)
+				failed.Errors = append(failed.Errors, retry.Errors...)
+				break
+			}
+			delay = retryAfter
+		}
+		log.Printf("Retrying %d certificates in %s", len(retry.Failed), delay)
+		time.Sleep(delay)
+		targets = retry.Failed
+	}
+	if len(failed.Failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// retryAfter records the latest time the ACME server asked to retry after
+type retryAfter struct {
+	lock  sync.Mutex
+	until time.Time
+}
+
+// When the ACME server asked to retry with `Retry-After` since the last reset
+var ACME_RETRY_AFTER = &retryAfter{}
+
+// Record records the `Retry-After` header, either a number of seconds or an
+// HTTP date
+func (r *retryAfter) Record(header string) {
+	var until time.Time
+	if seconds, err := strconv.Atoi(header); err == nil {
+		until = time.Now().Add(time.Duration(seconds) * time.Second)
+	} else if date, err := http.ParseTime(header); err == nil {
+		until = date
+	} else {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if until.After(r.until) {
+		r.until = until
+	}
+}
+
+// Delay returns how long is left to wait, or 0
+func (r *retryAfter) Delay() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if delay := r.until.Sub(time.Now()); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+func (r *retryAfter) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.until = time.Time{}
+}
+
+// retryAfterTransport records the `Retry-After` of rate limited and
+// unavailable responses, which lego doesn't pass on with its errors
+type retryAfterTransport struct {
+	transport http.RoundTripper
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if header := resp.Header.Get("Retry-After"); header != "" {
+			ACME_RETRY_AFTER.Record(header)
+		}
+	}
+	return resp, err
+}
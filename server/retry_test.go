@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class string
+	}{
+		{errors.New("Error getting secret `example-tls`"), ERROR_RETRYABLE},
+		{CAUnavailableError{URL: "https://acme.example.com/directory", Err: errors.New("timeout")}, ERROR_RETRYABLE},
+		{configError("Unknown secret layout %s", "pem"), ERROR_PERMANENT},
+		{wrapError("Error loading certificate", configError("Invalid CSR source %s", "pod/csr")), ERROR_PERMANENT},
+		{acme.RemoteError{StatusCode: 503, Detail: "Service Unavailable"}, ERROR_RETRYABLE},
+		{acme.RemoteError{StatusCode: 400, Type: "urn:acme:error:connection"}, ERROR_RETRYABLE},
+		{acme.RemoteError{StatusCode: 400, Type: "urn:ietf:params:acme:error:dns"}, ERROR_RETRYABLE},
+		{acme.NonceError{RemoteError: acme.RemoteError{StatusCode: 400, Type: "urn:acme:error:badNonce"}}, ERROR_RETRYABLE},
+		{acme.RemoteError{StatusCode: 429, Type: "urn:ietf:params:acme:error:rateLimited"}, ERROR_RATE_LIMITED},
+		{acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized"}, ERROR_PERMANENT},
+		{acme.RemoteError{StatusCode: 400, Type: "urn:ietf:params:acme:error:rejectedIdentifier"}, ERROR_PERMANENT},
+		{acme.TOSError{RemoteError: acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:malformed"}}, ERROR_PERMANENT},
+		{wrapError("Error finalizing order", acme.RemoteError{StatusCode: 400, Type: "urn:ietf:params:acme:error:badCSR"}), ERROR_PERMANENT},
+		{wrapError("Error querying registration", wrapError("Error getting authorization", acme.RemoteError{StatusCode: 400, Type: "urn:ietf:params:acme:error:rejectedIdentifier"})), ERROR_PERMANENT},
+		{wrapError("Error downloading certificate", acme.RemoteError{StatusCode: 503, Detail: "Service Unavailable"}), ERROR_RETRYABLE},
+		{wrapError("Error querying registration", CAUnavailableError{URL: "https://acme.example.com/directory", Err: errors.New("timeout")}), ERROR_RETRYABLE},
+		{ObtainError{Failures: map[string]error{
+			"a.example.com": acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized"},
+			"b.example.com": acme.RemoteError{StatusCode: 400, Type: "urn:acme:error:dns"},
+		}}, ERROR_RETRYABLE},
+		{ObtainError{Failures: map[string]error{
+			"a.example.com": acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized"},
+			"b.example.com": acme.RemoteError{StatusCode: 400, Type: "urn:ietf:params:acme:error:caa"},
+		}}, ERROR_PERMANENT},
+	} {
+		if classifyError(test.err) != test.class {
+			t.Errorf("Expected %s to be %s: %s", test.err, test.class, classifyError(test.err))
+		}
+	}
+
+	rateLimitErr := acme.RemoteError{StatusCode: 429, Type: "urn:ietf:params:acme:error:rateLimited"}
+	unauthorizedErr := acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized"}
+	for code, err := range map[int]error{
+		1:                    errors.New("Error getting secret `example-tls`"),
+		EXIT_RATE_LIMITED:    IssueError{Failed: make([]CertificateTarget, 2), Errors: []error{errors.New("timeout"), rateLimitErr}},
+		EXIT_PERMANENT_ERROR: IssueError{Failed: make([]CertificateTarget, 2), Errors: []error{rateLimitErr, wrapError("Error updating the contact", unauthorizedErr)}},
+	} {
+		if exitCode(err) != code {
+			t.Errorf("Expected exit code %d for %s: %d", code, err, exitCode(err))
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, InitialDelay: 4 * time.Second, MaxDelay: 30 * time.Second}
+	for retry, max := range map[int]time.Duration{1: 4 * time.Second, 2: 8 * time.Second, 3: 16 * time.Second, 4: 30 * time.Second, 9: 30 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if delay := policy.backoff(retry); delay < max/2 || delay > max {
+				t.Fatalf("Unexpected delay of retry %d: %s", retry, delay)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", r.URL.Query().Get("after"))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	withACMEHTTPClient(t, map[string]string{"ACME_CA_BUNDLE": ""}, func() {
+		ACME_RETRY_AFTER.Reset()
+		resp, err := acme.HTTPClient.Get(server.URL + "/new-order?after=120")
+		if err != nil {
+			t.Fatalf("Error requesting rate limited resource: %s", err)
+		}
+		resp.Body.Close()
+		if delay := ACME_RETRY_AFTER.Delay(); delay < 110*time.Second || delay > 120*time.Second {
+			t.Fatalf("Expected the Retry-After to be recorded: %s", delay)
+		}
+		// Only later times are recorded
+		resp, err = acme.HTTPClient.Get(server.URL + "/new-order?after=" + time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		if err != nil {
+			t.Fatalf("Error requesting rate limited resource: %s", err)
+		}
+		resp.Body.Close()
+		if delay := ACME_RETRY_AFTER.Delay(); delay < 110*time.Second {
+			t.Fatalf("Expected the later Retry-After to be kept: %s", delay)
+		}
+		ACME_RETRY_AFTER.Reset()
+		if delay := ACME_RETRY_AFTER.Delay(); delay != 0 {
+			t.Fatalf("Expected no delay after resetting: %s", delay)
+		}
+	})
+}
+
+func TestGenerateWithRetry(t *testing.T) {
+	for key, value := range map[string]string{"RETRY_ATTEMPTS": "3", "RETRY_INITIAL_DELAY": "1ms", "RETRY_MAX_DELAY": "10ms"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+	unauthorized := CertificateTarget{SecretName: "unauthorized-tls", Domains: []string{"unauthorized.example.com"}}
+	propagating := CertificateTarget{SecretName: "propagating-tls", Domains: []string{"propagating.example.com"}}
+	valid := CertificateTarget{SecretName: "valid-tls", Domains: []string{"valid.example.com"}}
+	unauthorizedErr := acme.RemoteError{StatusCode: 403, Type: "urn:acme:error:unauthorized"}
+	attempts := [][]string{}
+	err := generateWithRetry([]CertificateTarget{unauthorized, propagating, valid}, func(targets []CertificateTarget) error {
+		secretNames := []string{}
+		issueErr := IssueError{}
+		for _, target := range targets {
+			secretNames = append(secretNames, target.SecretName)
+			switch {
+			case target.SecretName == unauthorized.SecretName:
+				issueErr.Failed = append(issueErr.Failed, target)
+				issueErr.Errors = append(issueErr.Errors, unauthorizedErr)
+			case target.SecretName == propagating.SecretName && len(attempts) < 2:
+				issueErr.Failed = append(issueErr.Failed, target)
+				issueErr.Errors = append(issueErr.Errors, acme.RemoteError{StatusCode: 400, Type: "urn:acme:error:dns"})
+			}
+		}
+		attempts = append(attempts, secretNames)
+		if len(issueErr.Failed) == 0 {
+			return nil
+		}
+		return issueErr
+	})
+	if len(attempts) != 3 || len(attempts[1]) != 1 || attempts[1][0] != propagating.SecretName {
+		t.Fatalf("Expected only the certificate with a DNS error to be retried: %v", attempts)
+	}
+	issueErr, ok := err.(IssueError)
+	if !ok || len(issueErr.Failed) != 1 || issueErr.Errors[0] != unauthorizedErr || exitCode(err) != EXIT_PERMANENT_ERROR {
+		t.Fatalf("Expected the permanent error to be returned: %v", err)
+	}
+
+	// Retries run out
+	attempts = nil
+	err = generateWithRetry([]CertificateTarget{valid}, func(targets []CertificateTarget) error {
+		attempts = append(attempts, nil)
+		return CAUnavailableError{URL: "https://acme.example.com/directory", Err: errors.New("timeout")}
+	})
+	if len(attempts) != 3 || exitCode(err) != 1 {
+		t.Fatalf("Expected every attempt to be used: %d %v", len(attempts), err)
+	}
+
+	// Invalid configuration isn't retried
+	attempts = nil
+	err = generateWithRetry([]CertificateTarget{valid}, func(targets []CertificateTarget) error {
+		attempts = append(attempts, nil)
+		_, err := parseCertificateKeyType("dsa1024")
+		return err
+	})
+	if len(attempts) != 1 || exitCode(err) != EXIT_PERMANENT_ERROR {
+		t.Fatalf("Expected to stop on an invalid key type: %d %v", len(attempts), err)
+	}
+
+	// Rate limits longer than the maximum delay aren't waited for
+	attempts = nil
+	err = generateWithRetry([]CertificateTarget{valid}, func(targets []CertificateTarget) error {
+		attempts = append(attempts, nil)
+		ACME_RETRY_AFTER.Record("3600")
+		return acme.RemoteError{StatusCode: 429, Type: "urn:ietf:params:acme:error:rateLimited"}
+	})
+	if len(attempts) != 1 || exitCode(err) != EXIT_RATE_LIMITED {
+		t.Fatalf("Expected to stop when rate limited: %d %v", len(attempts), err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Annotations recording the revocation of the certificate in a secret
+var REVOKED_AT_ANNOTATION = "auto-kubernetes-lets-encrypt/revoked-at"
+var REVOKED_SERIAL_ANNOTATION = "auto-kubernetes-lets-encrypt/revoked-serial"
+
+// runRevoke implements the `revoke` subcommand, which revokes the certificate
+// stored in a secret and optionally replaces it right away
+func runRevoke(args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	domain := flags.String("domain", "", "Domain of the certificate in a legacy secret ($DOMAIN.crt). Only needed if the secret holds several")
+	reissue := flags.Bool("reissue", false, "Obtain a new certificate with a fresh key after revoking")
+	email := flags.String("email", Getenv("EMAIL", ""), "Email of the Let's Encrypt account")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s revoke [flags] <secret name>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("The secret name is required")
+	}
+	namespace, err := getNamespace()
+	if err != nil {
+		return err
+	}
+
+	target, certificate, err := revocationTarget(namespace, flags.Arg(0), *domain)
+	if err != nil {
+		return err
+	}
+	err = revokeCertificate(target, certificate, *email)
+	if err != nil {
+		return err
+	}
+	if !*reissue {
+		log.Printf("Secret `%s` still holds the revoked certificate. Pass `--reissue` to replace it.", target.SecretName)
+		return nil
+	}
+	log.Printf("Obtaining a new certificate for %s", target.Domains)
+	_, err = issueWithFailover(target, *email, obtainCertificate)
+	return err
+}
+
+// revocationTarget reads the certificate stored in the secret and returns it
+// with the target it's reissued to. `tls.crt` is used if the secret has one,
+// otherwise `$DOMAIN.crt`.
+func revocationTarget(namespace string, secretName string, domain string) (CertificateTarget, []byte, error) {
+	target := CertificateTarget{Namespace: namespace, SecretName: secretName}
+	data, err := getNamespacedSecret(namespace, secretName)
+	if err != nil {
+		return target, nil, err
+	}
+
+	var certificate []byte
+	var privateKey []byte
+	if len(data["tls.crt"]) > 0 {
+		target.Layout = SECRET_LAYOUT_TLS
+		certificate = data["tls.crt"]
+		privateKey = data["tls.key"]
+	} else {
+		target.Layout = SECRET_LAYOUT_LEGACY
+		if domain == "" {
+			domains := []string{}
+			for key := range data {
+				if strings.HasSuffix(key, ".crt") && !strings.HasSuffix(key, ".issuer.crt") {
+					domains = append(domains, strings.TrimSuffix(key, ".crt"))
+				}
+			}
+			if len(domains) != 1 {
+				return target, nil, fmt.Errorf("Found %d certificates in secret `%s`. Select one with `--domain`: %s", len(domains), secretName, strings.Join(domains, ", "))
+			}
+			domain = domains[0]
+		}
+		certificate = data[domainKey(domain)+".crt"]
+		privateKey = data[domainKey(domain)+".key"]
+		if len(certificate) == 0 {
+			return target, nil, fmt.Errorf("No certificate found for %s in secret `%s`", domain, secretName)
+		}
+	}
+
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return target, nil, fmt.Errorf("Error parsing the certificate in secret `%s`: %s", secretName, err)
+	}
+	target.Domains = certificateDomains(cert)
+	// Keep writing the legacy keys along with the TLS layout if they're there
+	target.LegacyKeys = target.Layout == SECRET_LAYOUT_TLS && len(data[domainKey(target.Domains[0])+".crt"]) > 0
+	// The new certificate gets a fresh key of the same type
+	if len(privateKey) > 0 {
+		if keyType, err := privateKeyType(privateKey); err == nil {
+			target.KeyType = keyType
+		}
+	}
+	return target, certificate, nil
+}
+
+// certificateDomains returns the domains of the certificate. The common name
+// is the first domain, like when the certificate was issued.
+func certificateDomains(cert *x509.Certificate) []string {
+	domains := []string{}
+	if cert.Subject.CommonName != "" {
+		domains = append(domains, cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		if name != cert.Subject.CommonName {
+			domains = append(domains, name)
+		}
+	}
+	return domains
+}
+
+func parseCertificate(certificate []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// revokeCertificate revokes the certificate with the account key of the ACME
+// server that issued it and records the revocation in the annotations of the
+// secret
+func revokeCertificate(target CertificateTarget, certificate []byte, email string) error {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return err
+	}
+	if issuer := loadIssuingCAServer(target); issuer != "" {
+		log.Printf("Revoking with %s, which issued the certificate", issuer)
+		ACTIVE_CA_SERVER = issuer
+		defer func() {
+			ACTIVE_CA_SERVER = ""
+		}()
+	}
+	serial := fmt.Sprintf("%x", cert.SerialNumber)
+	legoUser, err := getUserWithRegistration(email)
+	if err != nil {
+		return err
+	}
+	client, err := connectACMEServer(caServer(), legoUser, acme.RSA2048)
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoking certificate %s for %s in secret `%s`", serial, target.Domains, target.SecretName)
+	err = client.RevokeCertificate(certificate)
+	if err != nil {
+		return wrapError(fmt.Sprintf("Error revoking certificate %s", serial), err)
+	}
+	return annotateSecret(target.Namespace, target.SecretName, map[string]string{
+		REVOKED_AT_ANNOTATION:     time.Now().UTC().Format(time.RFC3339),
+		REVOKED_SERIAL_ANNOTATION: serial,
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func encodeSecretData(data map[string][]byte) map[string]string {
+	encoded := make(map[string]string)
+	for key, value := range data {
+		encoded[key] = base64.StdEncoding.EncodeToString(value)
+	}
+	return encoded
+}
+
+func TestRevocationTarget(t *testing.T) {
+	certificate, key := selfSignedCertificate(t, []string{"example.com", "www.example.com"}, time.Now().Add(time.Hour))
+	other, _ := selfSignedCertificate(t, []string{"example.org"}, time.Now().Add(time.Hour))
+	fake := &fakeSecretsServer{
+		secrets: map[string]Secret{
+			"/api/v1/namespaces/default/secrets/example-tls": {
+				Metadata: ObjectMeta{Name: "example-tls", Namespace: "default"},
+				Type:     SECRET_TYPE_TLS,
+				Data:     encodeSecretData(map[string][]byte{"tls.crt": certificate, "tls.key": key, "example.com.crt": certificate}),
+			},
+			"/api/v1/namespaces/default/secrets/legacy": {
+				Metadata: ObjectMeta{Name: "legacy", Namespace: "default"},
+				Data: encodeSecretData(map[string][]byte{
+					"example.com.crt":        certificate,
+					"example.com.issuer.crt": other,
+					"example.org.crt":        other,
+				}),
+			},
+		},
+	}
+	withFakeSecretsServer(t, fake, func() {
+		target, revoked, err := revocationTarget("default", "example-tls", "")
+		if err != nil {
+			t.Fatalf("Error reading certificate: %s", err)
+		}
+		if string(revoked) != string(certificate) || target.Layout != SECRET_LAYOUT_TLS || !target.LegacyKeys || target.KeyType != acme.EC256 {
+			t.Fatalf("Unexpected target: %#v", target)
+		}
+		if len(target.Domains) != 2 || target.Domains[0] != "example.com" || target.Domains[1] != "www.example.com" {
+			t.Fatalf("Unexpected domains: %v", target.Domains)
+		}
+
+		// The legacy secret holds two certificates
+		if _, _, err := revocationTarget("default", "legacy", ""); err == nil {
+			t.Fatalf("Expected an error without a domain")
+		}
+		target, revoked, err = revocationTarget("default", "legacy", "example.org")
+		if err != nil || string(revoked) != string(other) || target.Layout != SECRET_LAYOUT_LEGACY || target.Domains[0] != "example.org" {
+			t.Fatalf("Unexpected target: %#v %v", target, err)
+		}
+	})
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	fake := newFakeACMEServer()
+	fake.registered = true
+	certificate, key := selfSignedCertificate(t, []string{"example.com"}, time.Now().Add(time.Hour))
+	secrets := fakeAccountSecrets(t, fmt.Sprintf(`{"uri": "%s/reg/1"}`, fake.server.URL))
+	path := "/api/v1/namespaces/default/secrets/example-tls"
+	secrets.secrets[path] = Secret{
+		Metadata: ObjectMeta{Name: "example-tls", Namespace: "default"},
+		Type:     SECRET_TYPE_TLS,
+		Data:     encodeSecretData(map[string][]byte{"tls.crt": certificate, "tls.key": key}),
+	}
+	withFakeACMEServer(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			target, revoked, err := revocationTarget("default", "example-tls", "")
+			if err != nil {
+				t.Fatalf("Error reading certificate: %s", err)
+			}
+			err = revokeCertificate(target, revoked, "ops@example.com")
+			if err != nil {
+				t.Fatalf("Error revoking certificate: %s", err)
+			}
+		})
+	})
+	block, _ := pem.Decode(certificate)
+	if len(fake.revoked) != 1 || fake.revoked[0] != base64.URLEncoding.EncodeToString(block.Bytes) {
+		t.Fatalf("Expected the certificate to be revoked: %v", fake.revoked)
+	}
+	annotations := secrets.secrets[path].Metadata.Annotations
+	if annotations[REVOKED_SERIAL_ANNOTATION] != "1234" || annotations[REVOKED_AT_ANNOTATION] == "" {
+		t.Fatalf("Expected the revocation to be recorded: %v", annotations)
+	}
+}
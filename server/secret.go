@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Layouts of the secret certificates are written to. The legacy layout stores
+// every file under the name of the domain (`$DOMAIN.crt`, `$DOMAIN.key`, ...)
+// in an Opaque secret. The TLS layout writes a `kubernetes.io/tls` secret with
+// `tls.crt` (the full chain) and `tls.key`, which Ingress controllers expect.
+const (
+	SECRET_LAYOUT_LEGACY = "legacy"
+	SECRET_LAYOUT_TLS    = "tls"
+)
+
+const (
+	SECRET_TYPE_OPAQUE = "Opaque"
+	SECRET_TYPE_TLS    = "kubernetes.io/tls"
+)
+
+// secretLayout returns the layout of the target, falling back to `SECRET_LAYOUT`
+func secretLayout(target CertificateTarget) (string, error) {
+	layout := target.Layout
+	if layout == "" {
+		layout = Getenv("SECRET_LAYOUT", SECRET_LAYOUT_LEGACY)
+	}
+	if layout != SECRET_LAYOUT_LEGACY && layout != SECRET_LAYOUT_TLS {
+		return "", configError("Unknown secret layout %s (Expected `%s` or `%s`)", layout, SECRET_LAYOUT_LEGACY, SECRET_LAYOUT_TLS)
+	}
+	return layout, nil
+}
+
+// writeLegacyKeys returns whether the `$DOMAIN.*` keys are written along with
+// the TLS layout
+func writeLegacyKeys(target CertificateTarget) bool {
+	return target.LegacyKeys || Getenv("LEGACY_KEYS", "") == "true"
+}
+
+func certificateSecretType(layout string) string {
+	if layout == SECRET_LAYOUT_TLS {
+		return SECRET_TYPE_TLS
+	}
+	return SECRET_TYPE_OPAQUE
+}
+
+// prepareSecret makes sure the secret of the target exists with the type of
+// its layout before any request is made to the ACME server
+func prepareSecret(target CertificateTarget) error {
+	layout, err := secretLayout(target)
+	if err != nil {
+		return err
+	}
+	return ensureSecret(target.Namespace, target.SecretName, certificateSecretType(layout), target.Owner)
+}
+
+// domainKey returns the domain as used in secret keys and file names.
+// Wildcards are written with `_` like the lego CLI does, since `*` isn't
+// allowed in secret keys.
+func domainKey(domain string) string {
+	return strings.Replace(domain, "*", "_", -1)
+}
+
+// certificateSecretData returns the base64 encoded secret data the
+// certificate is stored as
+func certificateSecretData(target CertificateTarget, certificates acme.CertificateResource) (map[string]string, error) {
+	layout, err := secretLayout(target)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	// Certificates issued for a CSR come without a private key. The keys are
+	// still written (empty) so a key of an earlier certificate isn't left behind.
+	privateKey := ""
+	if certificates.PrivateKey != nil {
+		privateKey = base64.StdEncoding.EncodeToString(certificates.PrivateKey)
+	}
+	if layout == SECRET_LAYOUT_TLS {
+		chain := bytes.Join([][]byte{certificates.Certificate, certificates.IssuerCertificate}, nil)
+		data["tls.crt"] = base64.StdEncoding.EncodeToString(chain)
+		data["tls.key"] = privateKey
+		if !writeLegacyKeys(target) {
+			return data, nil
+		}
+	}
+
+	domain := domainKey(certificates.Domain)
+	data[domain+".crt"] = base64.StdEncoding.EncodeToString(certificates.Certificate)
+	data[domain+".key"] = privateKey
+	data[domain+".pem"] = ""
+	if certificates.PrivateKey != nil {
+		pemKey := bytes.Join([][]byte{certificates.Certificate, certificates.PrivateKey}, nil)
+		data[domain+".pem"] = base64.StdEncoding.EncodeToString(pemKey)
+	}
+	metadataJson, _ := json.MarshalIndent(certificates, "", "\t")
+	data[domain+".json"] = base64.StdEncoding.EncodeToString(metadataJson)
+	data[domain+".issuer.crt"] = base64.StdEncoding.EncodeToString(certificates.IssuerCertificate)
+	return data, nil
+}
+
+// certificateFromSecretData reads back a certificate written by
+// `certificateSecretData`
+func certificateFromSecretData(target CertificateTarget, data map[string][]byte) (acme.CertificateResource, error) {
+	certificates := acme.CertificateResource{}
+	layout, err := secretLayout(target)
+	if err != nil {
+		return certificates, err
+	}
+	domain := target.Domains[0]
+	certificates.Domain = domain
+	var privateKey []byte
+	if layout == SECRET_LAYOUT_TLS {
+		if len(data["tls.crt"]) == 0 {
+			return certificates, fmt.Errorf("No `tls.crt` found for %s", domain)
+		}
+		// The first certificate in the chain is the issued certificate, the
+		// rest are its issuers
+		block, rest := pem.Decode(data["tls.crt"])
+		if block == nil {
+			return certificates, fmt.Errorf("Error decoding `tls.crt` for %s", domain)
+		}
+		certificates.Certificate = pem.EncodeToMemory(block)
+		certificates.IssuerCertificate = bytes.TrimSpace(rest)
+		privateKey = data["tls.key"]
+	} else {
+		key := domainKey(domain)
+		if len(data[key+".crt"]) == 0 {
+			return certificates, fmt.Errorf("No certificate found for %s", domain)
+		}
+		if metadataJson, ok := data[key+".json"]; ok {
+			err = json.Unmarshal(metadataJson, &certificates)
+			if err != nil {
+				return certificates, fmt.Errorf("Error parsing certificate metadata for %s: %s", domain, err)
+			}
+		}
+		certificates.Domain = domain
+		certificates.Certificate = data[key+".crt"]
+		certificates.IssuerCertificate = data[key+".issuer.crt"]
+		privateKey = data[key+".key"]
+	}
+	if len(privateKey) > 0 {
+		if block, _ := pem.Decode(privateKey); block == nil {
+			return certificates, fmt.Errorf("Error decoding private key for %s", domain)
+		}
+		certificates.PrivateKey = privateKey
+	}
+	return certificates, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// StateStore persists what the server needs between runs: the account key,
+// the registration of the account and the issued certificates. The state is
+// read from the store every time it's needed, so changes made by other runs
+// (or by hand) are picked up without restarting.
+type StateStore interface {
+	// LoadOrCreateAccountKey returns the stored account key, storing the key
+	// returned by `generate` if there is none yet
+	LoadOrCreateAccountKey(generate func() ([]byte, error)) ([]byte, error)
+	// LoadAccountKey returns the stored account key or nil if there is none
+	LoadAccountKey() ([]byte, error)
+	// SaveAccountKey replaces the stored account key
+	SaveAccountKey(privateKey []byte) error
+	// SavePendingAccountKey stores the key the account is being rolled over
+	// to, so it isn't lost if storing it as the account key fails
+	SavePendingAccountKey(privateKey []byte) error
+	// ClearAccount removes the account key, registration and external
+	// account binding
+	ClearAccount() error
+	// LoadRegistration returns the stored registration or nil if there is none
+	LoadRegistration() (*acme.RegistrationResource, error)
+	SaveRegistration(registration acme.RegistrationResource) error
+	// LoadExternalAccountKeyID returns the key ID of the external account the
+	// account is bound to, or "" if it isn't bound
+	LoadExternalAccountKeyID() (string, error)
+	SaveExternalAccountKeyID(keyID string) error
+	LoadCertificate(target CertificateTarget) (acme.CertificateResource, error)
+	SaveCertificate(target CertificateTarget, certificates acme.CertificateResource) error
+}
+
+// SecretStateStore keeps the state in Kubernetes secrets. The account key,
+// registration and bound external account are stored in `AccountSecretName`
+// (`private_key`, `registration` and `eab_bound_key_id`, followed by
+// `AccountKeySuffix`) in the namespace of the server, each certificate in the
+// secret of its target.
+type SecretStateStore struct {
+	AccountSecretName string
+	// Suffix of the account keys of the ACME server. See `accountKeySuffix`.
+	AccountKeySuffix string
+}
+
+// How many times storing the account key is retried when the account secret
+// is changed concurrently
+var ACCOUNT_KEY_ATTEMPTS = 5
+
+func getStateStore() StateStore {
+	return SecretStateStore{
+		AccountSecretName: Getenv("LETS_ENCRYPT_USER_SECRET_NAME", ""),
+		AccountKeySuffix:  accountKeySuffix(caServer()),
+	}
+}
+
+// key returns the name of the account secret key holding the value
+func (s SecretStateStore) key(name string) string {
+	return name + s.AccountKeySuffix
+}
+
+func (s SecretStateStore) accountSecret() (string, string, error) {
+	if s.AccountSecretName == "" {
+		return "", "", configError("Environment variable `LETS_ENCRYPT_USER_SECRET_NAME` required")
+	}
+	namespace, err := getNamespace()
+	if err != nil {
+		return "", "", err
+	}
+	return namespace, s.AccountSecretName, nil
+}
+
+// LoadOrCreateAccountKey only stores a generated key if the account secret
+// didn't change since it was read, so concurrent first runs end up using the
+// same key (and account)
+func (s SecretStateStore) LoadOrCreateAccountKey(generate func() ([]byte, error)) ([]byte, error) {
+	namespace, secretName, err := s.accountSecret()
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < ACCOUNT_KEY_ATTEMPTS; attempt++ {
+		secret, err := lookupSecret(namespace, secretName)
+		if err != nil {
+			return nil, err
+		}
+		if secret != nil && secret.Data[s.key("private_key")] != "" {
+			log.Printf("Using account key from secret `%s`", secretName)
+			return base64.StdEncoding.DecodeString(secret.Data[s.key("private_key")])
+		}
+
+		log.Printf("No account key found in secret `%s`", secretName)
+		privateKey, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		data := map[string]string{s.key("private_key"): base64.StdEncoding.EncodeToString(privateKey)}
+		if secret == nil {
+			err = createSecret(Secret{
+				Metadata: ObjectMeta{Name: secretName, Namespace: namespace, Labels: SECRET_LABELS},
+				Type:     SECRET_TYPE_OPAQUE,
+				Data:     data,
+			})
+		} else {
+			err = patchSecret(namespace, secretName, secret.Metadata.ResourceVersion, data)
+		}
+		if err == ErrSecretConflict {
+			log.Printf("Secret `%s` changed while storing the account key. Reading it again.", secretName)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	}
+	return nil, fmt.Errorf("Secret `%s` kept changing while storing the account key", secretName)
+}
+
+func (s SecretStateStore) LoadAccountKey() ([]byte, error) {
+	namespace, secretName, err := s.accountSecret()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := lookupSecret(namespace, secretName)
+	if err != nil || secret == nil || secret.Data[s.key("private_key")] == "" {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(secret.Data[s.key("private_key")])
+}
+
+func (s SecretStateStore) SaveAccountKey(privateKey []byte) error {
+	return s.updateAccountSecret(map[string]string{
+		s.key("private_key"):         base64.StdEncoding.EncodeToString(privateKey),
+		s.key("pending_private_key"): "",
+	})
+}
+
+func (s SecretStateStore) SavePendingAccountKey(privateKey []byte) error {
+	return s.updateAccountSecret(map[string]string{s.key("pending_private_key"): base64.StdEncoding.EncodeToString(privateKey)})
+}
+
+func (s SecretStateStore) ClearAccount() error {
+	return s.updateAccountSecret(map[string]string{s.key("private_key"): "", s.key("registration"): "", s.key("eab_bound_key_id"): ""})
+}
+
+func (s SecretStateStore) updateAccountSecret(updates map[string]string) error {
+	namespace, secretName, err := s.accountSecret()
+	if err != nil {
+		return err
+	}
+	return updateSecret(secretName, NewNamespacedSecretUpdate(namespace, secretName, updates))
+}
+
+func (s SecretStateStore) LoadRegistration() (*acme.RegistrationResource, error) {
+	namespace, secretName, err := s.accountSecret()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := lookupSecret(namespace, secretName)
+	if err != nil || secret == nil || secret.Data[s.key("registration")] == "" {
+		return nil, err
+	}
+	registrationJson, err := base64.StdEncoding.DecodeString(secret.Data[s.key("registration")])
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding registration: %s", err)
+	}
+	if len(registrationJson) == 0 {
+		return nil, nil
+	}
+	registration := &acme.RegistrationResource{}
+	err = json.Unmarshal(registrationJson, registration)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing registration: %s", err)
+	}
+	return registration, nil
+}
+
+func (s SecretStateStore) SaveRegistration(registration acme.RegistrationResource) error {
+	registrationJson, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+	return s.updateAccountSecret(map[string]string{s.key("registration"): base64.StdEncoding.EncodeToString(registrationJson)})
+}
+
+func (s SecretStateStore) LoadExternalAccountKeyID() (string, error) {
+	namespace, secretName, err := s.accountSecret()
+	if err != nil {
+		return "", err
+	}
+	secret, err := lookupSecret(namespace, secretName)
+	if err != nil || secret == nil {
+		return "", err
+	}
+	keyID, err := base64.StdEncoding.DecodeString(secret.Data[s.key("eab_bound_key_id")])
+	if err != nil {
+		return "", fmt.Errorf("Error decoding bound external account: %s", err)
+	}
+	return string(keyID), nil
+}
+
+func (s SecretStateStore) SaveExternalAccountKeyID(keyID string) error {
+	return s.updateAccountSecret(map[string]string{s.key("eab_bound_key_id"): base64.StdEncoding.EncodeToString([]byte(keyID))})
+}
+
+func (s SecretStateStore) LoadCertificate(target CertificateTarget) (acme.CertificateResource, error) {
+	data, err := getNamespacedSecret(target.Namespace, target.SecretName)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+	return certificateFromSecretData(target, data)
+}
+
+func (s SecretStateStore) SaveCertificate(target CertificateTarget, certificates acme.CertificateResource) error {
+	layout, err := secretLayout(target)
+	if err != nil {
+		return err
+	}
+	updates, err := certificateSecretData(target, certificates)
+	if err != nil {
+		return err
+	}
+	update := NewNamespacedSecretUpdate(target.Namespace, target.SecretName, updates)
+	update.Type = certificateSecretType(layout)
+	err = updateSecret(target.SecretName, update)
+	if err != nil {
+		return fmt.Errorf("Error updating secret in kubernetes: %s", err)
+	}
+	return nil
+}
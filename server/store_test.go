@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+func TestSecretStateStoreLoadOrCreateAccountKey(t *testing.T) {
+	store := SecretStateStore{AccountSecretName: "lets-encrypt-user"}
+	generate := func() ([]byte, error) {
+		return generateAccountKey(acme.EC256)
+	}
+	path := "/api/v1/namespaces/default/secrets/lets-encrypt-user"
+
+	// The secret is created with a new key, which is loaded on the next run
+	fake := &fakeSecretsServer{secrets: make(map[string]Secret)}
+	withFakeSecretsServer(t, fake, func() {
+		privateKey, err := store.LoadOrCreateAccountKey(generate)
+		if err != nil {
+			t.Fatalf("Error creating account key: %s", err)
+		}
+		key, err := parseAccountKey(privateKey)
+		if err != nil {
+			t.Fatalf("Error parsing account key: %s", err)
+		}
+		if _, ok := key.(*ecdsa.PrivateKey); !ok {
+			t.Fatalf("Expected an ECDSA key")
+		}
+		stored, _ := base64.StdEncoding.DecodeString(fake.secrets[path].Data["private_key"])
+		if string(stored) != string(privateKey) {
+			t.Fatalf("Account key was not stored in the secret")
+		}
+		loaded, err := store.LoadOrCreateAccountKey(generate)
+		if err != nil || string(loaded) != string(privateKey) {
+			t.Fatalf("Expected the stored key to be loaded: %s", err)
+		}
+	})
+
+	// Another run stores its key first
+	otherKey, _ := generateAccountKey(acme.EC256)
+	fake = &fakeSecretsServer{
+		secrets: map[string]Secret{
+			path: {
+				Metadata: ObjectMeta{Name: "lets-encrypt-user", Namespace: "default", ResourceVersion: "1"},
+				Data:     map[string]string{"registration": ""},
+			},
+		},
+		beforeWrite: func(f *fakeSecretsServer, path string) {
+			secret := f.secrets[path]
+			if secret.Data["private_key"] == "" {
+				secret.Data["private_key"] = base64.StdEncoding.EncodeToString(otherKey)
+				secret.Metadata.ResourceVersion = "2"
+				f.secrets[path] = secret
+			}
+		},
+	}
+	withFakeSecretsServer(t, fake, func() {
+		privateKey, err := store.LoadOrCreateAccountKey(generate)
+		if err != nil {
+			t.Fatalf("Error creating account key: %s", err)
+		}
+		if string(privateKey) != string(otherKey) {
+			t.Fatalf("Expected the key stored concurrently to be used")
+		}
+	})
+}
+
+func TestSecretStateStoreRegistration(t *testing.T) {
+	store := SecretStateStore{AccountSecretName: "lets-encrypt-user"}
+	path := "/api/v1/namespaces/default/secrets/lets-encrypt-user"
+	fake := &fakeSecretsServer{
+		secrets: map[string]Secret{
+			path: {
+				Metadata: ObjectMeta{Name: "lets-encrypt-user", Namespace: "default", ResourceVersion: "1"},
+				Data:     map[string]string{"private_key": "a2V5", "registration": ""},
+			},
+		},
+	}
+	withFakeSecretsServer(t, fake, func() {
+		registration, err := store.LoadRegistration()
+		if err != nil || registration != nil {
+			t.Fatalf("Expected no registration: %v %s", registration, err)
+		}
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		saved := acme.RegistrationResource{URI: "https://acme.example.com/reg/1"}
+		saved.Body.Key = jose.JsonWebKey{Key: &key.PublicKey}
+		err = store.SaveRegistration(saved)
+		if err != nil {
+			t.Fatalf("Error saving registration: %s", err)
+		}
+		// Read back from the secret, not from a copy kept in the process
+		registration, err = store.LoadRegistration()
+		if err != nil || registration == nil || registration.URI != "https://acme.example.com/reg/1" {
+			t.Fatalf("Expected the saved registration: %v %s", registration, err)
+		}
+		if fake.secrets[path].Data["private_key"] != "a2V5" {
+			t.Fatalf("Expected the account key to be kept")
+		}
+	})
+}
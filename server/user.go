@@ -2,16 +2,13 @@ package main
 
 import (
 	"crypto"
-	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
 )
 
 // You'll need a user or account type that implements acme.User
@@ -34,22 +31,11 @@ func (u LegoUser) GetPrivateKey() crypto.PrivateKey {
 func getUser(email string) (LegoUser, error) {
 	// Create a user. New accounts need an email and private key to start.
 	log.Printf("Get user")
-	privateKeyStr := Getenv("LETS_ENCRYPT_USER_PRIVATE_KEY", "")
 	var user LegoUser
-	if privateKeyStr == "" {
-		log.Printf("Private key not found for user")
-		return user, errors.New("Environment variable `LETS_ENCRYPT_USER_PRIVATE_KEY ` required")
-	}
-	log.Printf("Decoding pem key")
-	pemKey, decodeErr := pem.Decode([]byte(privateKeyStr))
-	if pemKey == nil {
-		log.Printf("Error decoding private key: (Rest: %s)", decodeErr)
-		return user, fmt.Errorf("Error decoding private key (Rest: %s)", decodeErr)
-	}
-	key, parseErr := x509.ParsePKCS1PrivateKey(pemKey.Bytes)
-	if parseErr != nil {
-		log.Printf("Error parsing private key: %s", parseErr)
-		return user, parseErr
+	key, err := getAccountKey()
+	if err != nil {
+		log.Printf("Error getting private key: %s", err)
+		return user, err
 	}
 	log.Printf("Private key found")
 	user = LegoUser{
@@ -59,74 +45,230 @@ func getUser(email string) (LegoUser, error) {
 	return user, nil
 }
 
+// getUserWithRegistration returns the user of the stored account. Unlike
+// `getUser` it never generates an account key, so commands that need an
+// existing account don't create one.
 func getUserWithRegistration(email string) (LegoUser, error) {
-	user, err := getUser(email)
+	var user LegoUser
+	registration, err := getStateStore().LoadRegistration()
 	if err != nil {
+		log.Printf("Error loading registration: %s", err)
 		return user, err
 	}
-	registrationJson := Getenv("LETS_ENCRYPT_USER_REGISTRATION", "")
-	log.Printf("Registration JSON: %s", registrationJson)
-	if registrationJson == "" {
+	if registration == nil {
 		log.Printf("Error finding user registration")
 		return user, errors.New("Error getting user registration from secret. Register user first.")
 	}
-	registration := acme.RegistrationResource{}
-	err = json.Unmarshal([]byte(registrationJson), &registration)
+	key, err := loadAccountKey()
 	if err != nil {
-		log.Printf("Error marshaling json for registration: %s", err)
+		log.Printf("Error getting private key: %s", err)
 		return user, err
 	}
-	log.Printf("Populating user with registration: %s", registration)
-	user.Registration = &registration
+	log.Printf("Populating user with registration: %v", *registration)
+	user = LegoUser{
+		Email:        email,
+		Registration: registration,
+		key:          key,
+	}
 	return user, nil
 }
 
+// caServer returns the directory URL of the ACME server, which is the first of
+// `caServers()` unless failing over to another one
+func caServer() string {
+	if ACTIVE_CA_SERVER != "" {
+		return ACTIVE_CA_SERVER
+	}
+	return caServers()[0]
+}
+
+// ensureRegistration returns the user with a valid registration. A stored
+// registration is validated with the ACME server first, so the account is
+// only registered if there is no valid registration for the key yet.
+func ensureRegistration(email string) (LegoUser, error) {
+	user, err := getUser(email)
+	if err != nil {
+		return user, err
+	}
+	stored, err := getStateStore().LoadRegistration()
+	if err != nil {
+		log.Printf("Ignoring stored registration: %s", err)
+	}
+	if stored == nil || stored.URI == "" {
+		return registerUser(user)
+	}
+
+	user.Registration = stored
+	registration, err := queryRegistration(user)
+	if err != nil {
+		return user, err
+	}
+	if registration == nil {
+		log.Printf("Stored registration %s is not valid. Registering again.", stored.URI)
+		return registerUser(user)
+	}
+	log.Printf("Using existing registration %s", registration.URI)
+	user.Registration = registration
+	if user.Email != "" && !contactMatches(registration.Body.Contact, user.Email) {
+		return updateContact(user)
+	}
+	storedJson, _ := json.Marshal(*stored)
+	registrationJson, err := json.Marshal(*registration)
+	if err != nil {
+		return user, err
+	}
+	if string(storedJson) == string(registrationJson) {
+		return user, nil
+	}
+	return user, saveRegistration(user)
+}
+
+// queryRegistration fetches the registration of the user from the ACME
+// server. It returns nil if the server doesn't know the account.
+func queryRegistration(user LegoUser) (*acme.RegistrationResource, error) {
+	directory, err := fetchACMEv2Directory(caServer())
+	if err != nil {
+		return nil, err
+	}
+	if directory != nil {
+		return queryACMEv2Registration(directory, user)
+	}
+	client, err := acme.NewClient(caServer(), &user, acme.RSA2048)
+	if err != nil {
+		return nil, err
+	}
+	registration, err := client.QueryRegistration()
+	if err == nil {
+		return registration, nil
+	}
+	switch remoteErr := err.(type) {
+	case acme.TOSError:
+		// The account exists but needs to agree to the new terms of service,
+		// which is done before every order
+		return user.Registration, nil
+	case acme.RemoteError:
+		if remoteErr.StatusCode == 401 || remoteErr.StatusCode == 403 || remoteErr.StatusCode == 404 {
+			return nil, nil
+		}
+	}
+	return nil, wrapError(fmt.Sprintf("Error querying registration %s", user.Registration.URI), err)
+}
+
+// queryACMEv2Registration fetches the account at the URI of the registration.
+// It returns nil if the account isn't valid, including a URI of another
+// server (e.g. an ACME v1 registration), since registering the key again
+// returns its existing account.
+func queryACMEv2Registration(directory *ACMEv2Directory, user LegoUser) (*acme.RegistrationResource, error) {
+	client := newACMEv2Client(directory, user.key, user.Registration.URI, "")
+	account, err := client.Account()
+	if remoteErr, ok := err.(acme.RemoteError); ok && remoteErr.StatusCode >= 400 && remoteErr.StatusCode < 500 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapError(fmt.Sprintf("Error querying registration %s", user.Registration.URI), err)
+	}
+	if account.Status != "valid" {
+		log.Printf("Account %s is %s", user.Registration.URI, account.Status)
+		return nil, nil
+	}
+	registration := *user.Registration
+	registration.Body.Contact = account.Contact
+	registration.TosURL = directory.Meta.TermsOfService
+	return &registration, nil
+}
+
 func registerUser(user LegoUser) (LegoUser, error) {
 	log.Printf("Register user...")
-	caServerHost := Getenv("CA_SERVER", "https://acme-v01.api.letsencrypt.org/directory")
+	caServerHost := caServer()
 	log.Printf("Creating new user from CA server: %s", caServerHost)
+	directory, err := fetchACMEv2Directory(caServerHost)
+	if err != nil {
+		return user, err
+	}
+	if directory != nil {
+		return registerACMEv2User(directory, user)
+	}
 	client, err := acme.NewClient(caServerHost, &user, acme.RSA2048)
-	log.Printf("Registering user: %s", user)
+	if err != nil {
+		log.Printf("Error creating acme client: %s", err)
+		return user, err
+	}
+	log.Printf("Registering user: %s", user.Email)
+	// If the key is already registered the existing registration is returned
 	reg, err := client.Register()
 	if err != nil {
 		log.Printf("Error registering user: %s", err)
 		return user, err
 	}
 	user.Registration = reg
-	log.Printf("User registered: %s", reg)
+	log.Printf("User registered: %v", reg)
 	err = saveRegistration(user)
 	if err != nil {
-		log.Printf("Error saving user registration", err)
+		log.Printf("Error saving user registration: %s", err)
 		return user, err
 	}
 	return user, nil
 }
 
-func saveRegistration(user LegoUser) error {
-	log.Printf("Save registration...")
-	if user.Registration == nil {
-		log.Printf("User has no registration", user)
-		return errors.New("User has no registration")
+// registerACMEv2User registers the account and stores its URL, which is the
+// key ID of every later request, as the URI of the registration
+func registerACMEv2User(directory *ACMEv2Directory, user LegoUser) (LegoUser, error) {
+	publicKey, err := accountPublicKey(user.key)
+	if err != nil {
+		return user, err
 	}
-	secretName := Getenv("LETS_ENCRYPT_USER_SECRET_NAME", "")
-	if secretName == "" {
-		return errors.New("Environment variable `SECRET_NAME` required for saving certs")
+	contact := []string{}
+	if user.Email != "" {
+		contact = append(contact, "mailto:"+user.Email)
 	}
-	updates := make(map[string]string)
-	log.Printf("Registratio: %s", *user.Registration)
-	registrationUpdatesJson, err := json.Marshal(*user.Registration)
+	binding, err := loadExternalAccountBinding()
 	if err != nil {
-		return err
+		return user, err
+	}
+	store := getStateStore()
+	boundKeyID, err := store.LoadExternalAccountKeyID()
+	if err != nil {
+		return user, err
 	}
-	updates["registration"] = base64.StdEncoding.EncodeToString(registrationUpdatesJson)
-	update, err := NewSecretUpdate(secretName, updates)
+	client := newACMEv2Client(directory, user.key, "", "")
+	log.Printf("Registering user: %s", user.Email)
+	account, bound, err := registerBoundAccount(client, contact, binding, boundKeyID)
 	if err != nil {
-		return err
+		log.Printf("Error registering user: %s", err)
+		return user, err
+	}
+	if bound && binding.KeyID != boundKeyID {
+		log.Printf("Account bound to external account `%s`", binding.KeyID)
+		err = store.SaveExternalAccountKeyID(binding.KeyID)
+		if err != nil {
+			return user, err
+		}
+	} else if binding != nil && binding.KeyID != boundKeyID {
+		log.Printf("Existing account is bound to external account `%s`, not `%s`. Keeping the binding.", boundKeyID, binding.KeyID)
 	}
-	err = updateSecret(secretName, update)
+	user.Registration = &acme.RegistrationResource{
+		URI:    client.accountURL,
+		TosURL: directory.Meta.TermsOfService,
+		Body: acme.Registration{
+			Key:     jose.JsonWebKey{Key: publicKey},
+			Contact: account.Contact,
+		},
+	}
+	log.Printf("User registered: %s", user.Registration.URI)
+	err = saveRegistration(user)
 	if err != nil {
-		return err
+		log.Printf("Error saving user registration: %s", err)
+		return user, err
+	}
+	return user, nil
+}
+
+func saveRegistration(user LegoUser) error {
+	log.Printf("Save registration...")
+	if user.Registration == nil {
+		log.Printf("User has no registration: %s", user.Email)
+		return errors.New("User has no registration")
 	}
-	os.Setenv("LETS_ENCRYPT_USER_REGISTRATION", string(registrationUpdatesJson))
-	return nil
+	log.Printf("Registration: %v", *user.Registration)
+	return getStateStore().SaveRegistration(*user.Registration)
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// fakeACMEServer is an ACME v1 server that only knows about registrations
+type fakeACMEServer struct {
+	sync.Mutex
+	server *httptest.Server
+	// Whether the account of the key exists
+	registered bool
+	requests   []string
+	// Key the account was registered with, as sent in the JWS header
+	key     json.RawMessage
+	contact []string
+	status  string
+	// Keys the account was rolled over to
+	newKeys []json.RawMessage
+	// Revoked certificates (base64url encoded DER)
+	revoked []string
+}
+
+func newFakeACMEServer() *fakeACMEServer {
+	f := &fakeACMEServer{contact: []string{"mailto:ops@example.com"}, status: "valid"}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	body, _ := ioutil.ReadAll(r.Body)
+	if key := requestKey(body); key != nil {
+		f.key = key
+	}
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", len(f.requests)))
+	links := func() {
+		w.Header().Add("Link", fmt.Sprintf(`<%s/new-authz>;rel="next"`, f.server.URL))
+		w.Header().Add("Link", fmt.Sprintf(`<%s/terms>;rel="terms-of-service"`, f.server.URL))
+	}
+	problem := func(status int, detail string) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"type": "urn:acme:error:unauthorized", "detail": detail})
+	}
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"key-change":  f.server.URL + "/key-change",
+			"new-authz":   f.server.URL + "/new-authz",
+			"new-cert":    f.server.URL + "/new-cert",
+			"new-reg":     f.server.URL + "/new-reg",
+			"revoke-cert": f.server.URL + "/revoke-cert",
+		})
+	case "/new-reg":
+		w.Header().Set("Location", f.server.URL+"/reg/1")
+		if f.registered {
+			problem(409, "Registration key is already in use")
+			return
+		}
+		f.registered = true
+		links()
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "key": f.key, "contact": f.contact})
+	case "/reg/1":
+		if !f.registered {
+			problem(403, "No registration exists matching provided key")
+			return
+		}
+		update := struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}{}
+		json.Unmarshal(verifiedPayload(body), &update)
+		if update.Contact != nil {
+			f.contact = update.Contact
+		}
+		if update.Status != "" {
+			f.status = update.Status
+		}
+		links()
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "key": f.key, "contact": f.contact, "agreement": f.server.URL + "/terms", "Status": f.status})
+	case "/key-change":
+		// The payload is the JWS signed by the new key
+		inner := verifiedPayload(body)
+		request := struct {
+			Account string          `json:"account"`
+			NewKey  json.RawMessage `json:"newKey"`
+		}{}
+		json.Unmarshal(verifiedPayload(inner), &request)
+		if request.Account != f.server.URL+"/reg/1" || len(request.NewKey) == 0 || requestKey(inner) == nil {
+			problem(400, "Invalid key change")
+			return
+		}
+		f.newKeys = append(f.newKeys, request.NewKey)
+		w.WriteHeader(200)
+	case "/revoke-cert":
+		request := struct {
+			Certificate string `json:"certificate"`
+		}{}
+		json.Unmarshal(verifiedPayload(body), &request)
+		if request.Certificate == "" {
+			problem(400, "No certificate")
+			return
+		}
+		f.revoked = append(f.revoked, request.Certificate)
+		w.WriteHeader(200)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// requestKey returns the JWK in the protected header of a JWS request
+func requestKey(body []byte) json.RawMessage {
+	jws := struct {
+		Protected string `json:"protected"`
+	}{}
+	if json.Unmarshal(body, &jws) != nil {
+		return nil
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil
+	}
+	header := struct {
+		JWK json.RawMessage `json:"jwk"`
+	}{}
+	json.Unmarshal(protected, &header)
+	return header.JWK
+}
+
+// verifiedPayload returns the payload of a JWS request signed by the key in
+// its header, or nil
+func verifiedPayload(body []byte) []byte {
+	signed, err := jose.ParseSigned(string(body))
+	if err != nil || len(signed.Signatures) != 1 || signed.Signatures[0].Header.JsonWebKey == nil {
+		return nil
+	}
+	payload, err := signed.Verify(signed.Signatures[0].Header.JsonWebKey.Key)
+	if err != nil {
+		return nil
+	}
+	return payload
+}
+
+func (f *fakeACMEServer) count(request string) int {
+	f.Lock()
+	defer f.Unlock()
+	count := 0
+	for _, r := range f.requests {
+		if r == request {
+			count++
+		}
+	}
+	return count
+}
+
+// withFakeACMEServer points the ACME client at the fake server
+func withFakeACMEServer(t *testing.T, fake *fakeACMEServer, test func()) {
+	defer fake.server.Close()
+	for key, value := range map[string]string{
+		"CA_SERVER":                     fake.server.URL + "/directory",
+		"LETS_ENCRYPT_USER_SECRET_NAME": "lets-encrypt-user",
+	} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+	test()
+}
+
+// fakeAccountSecrets returns a secrets server holding an account secret with a
+// new key and the registration
+func fakeAccountSecrets(t *testing.T, registration string) *fakeSecretsServer {
+	privateKey, err := generateAccountKey(acme.EC256)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	return &fakeSecretsServer{
+		secrets: map[string]Secret{
+			"/api/v1/namespaces/default/secrets/lets-encrypt-user": {
+				Metadata: ObjectMeta{Name: "lets-encrypt-user", Namespace: "default", ResourceVersion: "1"},
+				Data: map[string]string{
+					"private_key":  base64.StdEncoding.EncodeToString(privateKey),
+					"registration": base64.StdEncoding.EncodeToString([]byte(registration)),
+				},
+			},
+		},
+	}
+}
+
+func TestEnsureRegistrationReusesValidRegistration(t *testing.T) {
+	fake := newFakeACMEServer()
+	fake.registered = true
+	secrets := fakeAccountSecrets(t, fmt.Sprintf(`{"uri": "%s/reg/1"}`, fake.server.URL))
+	withFakeACMEServer(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			user, err := ensureRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error ensuring registration: %s", err)
+			}
+			if user.Registration.URI != fake.server.URL+"/reg/1" || user.Registration.NewAuthzURL == "" {
+				t.Fatalf("Unexpected registration: %#v", user.Registration)
+			}
+			// Saved since the query returned more than was stored
+			patches := 0
+			for _, request := range secrets.requests {
+				if request == "PATCH /api/v1/namespaces/default/secrets/lets-encrypt-user" {
+					patches++
+				}
+			}
+			if patches != 1 {
+				t.Fatalf("Expected the updated registration to be saved: %v", secrets.requests)
+			}
+
+			// The second time nothing changed
+			secrets.requests = nil
+			_, err = ensureRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error ensuring registration: %s", err)
+			}
+			for _, request := range secrets.requests {
+				if request != "GET /api/v1/namespaces/default/secrets/lets-encrypt-user" {
+					t.Fatalf("Expected the registration not to be saved again: %v", secrets.requests)
+				}
+			}
+		})
+	})
+	if fake.count("POST /new-reg") != 0 {
+		t.Fatalf("Expected no new registration: %v", fake.requests)
+	}
+}
+
+func TestEnsureRegistrationRegistersWithoutValidRegistration(t *testing.T) {
+	// The stored registration is unknown to the server
+	fake := newFakeACMEServer()
+	secrets := fakeAccountSecrets(t, fmt.Sprintf(`{"uri": "%s/reg/1"}`, fake.server.URL))
+	withFakeACMEServer(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			user, err := ensureRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error ensuring registration: %s", err)
+			}
+			if user.Registration.URI != fake.server.URL+"/reg/1" {
+				t.Fatalf("Unexpected registration: %#v", user.Registration)
+			}
+		})
+	})
+	if fake.count("POST /new-reg") != 1 {
+		t.Fatalf("Expected a new registration: %v", fake.requests)
+	}
+
+	// The key is already registered but no registration is stored
+	fake = newFakeACMEServer()
+	fake.registered = true
+	secrets = fakeAccountSecrets(t, "")
+	withFakeACMEServer(t, fake, func() {
+		withFakeSecretsServer(t, secrets, func() {
+			user, err := ensureRegistration("ops@example.com")
+			if err != nil {
+				t.Fatalf("Error recovering from the conflict: %s", err)
+			}
+			if user.Registration.URI != fake.server.URL+"/reg/1" {
+				t.Fatalf("Expected the existing registration: %#v", user.Registration)
+			}
+		})
+	})
+	if fake.count("POST /reg/1") != 1 {
+		t.Fatalf("Expected the existing registration to be fetched: %v", fake.requests)
+	}
+}
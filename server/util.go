@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 )
 
 // func SendError(w http.ResponseWriter, response interface{}) {
@@ -18,9 +19,7 @@ import (
 func SendJson(w http.ResponseWriter, response interface{}) {
 	json, err := json.Marshal(response)
 	if err != nil {
-		log.Fatal("Error marshalling HTTP response: %s - %s", response, err)
-		panic(err)
-		return
+		log.Fatalf("Error marshalling HTTP response: %v - %s", response, err)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(json)
@@ -34,6 +33,17 @@ func Getenv(key, fallback string) string {
 	return value
 }
 
+// keys returns the keys of a map, which is useful for logging secret updates
+// without logging their values
+func keys(data map[string]string) []string {
+	keys := []string{}
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func newUUID() (string, error) {
 	uuid := make([]byte, 16)
 	n, err := io.ReadFull(rand.Reader, uuid)